@@ -0,0 +1,20 @@
+package main
+
+// cpusFor returns the CPUs the ffmpeg processes of the given worker (1 for
+// the first) are pinned to with -affinity. The ncpu CPUs are split into
+// equal consecutive ranges, one per worker, so with 16 CPUs and 4 workers
+// worker 1 gets CPUs 0-3 and worker 4 gets 12-15. CPUs left over from an
+// uneven split go unused, and with more workers than CPUs they share them
+// round-robin.
+func cpusFor(worker, workers, ncpu int) []int {
+	per := ncpu / workers
+	if per < 1 {
+		per = 1
+	}
+	start := (worker - 1) * per % ncpu
+	cpus := make([]int, per)
+	for i := range cpus {
+		cpus[i] = start + i
+	}
+	return cpus
+}
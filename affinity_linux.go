@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const affinitySupported = true
+
+// startPinned starts cmd pinned to cpus, or unpinned if there are none. The
+// affinity is set on a locked OS thread that cmd is forked from, so ffmpeg
+// and every thread it starts inherit it.
+func startPinned(cmd *exec.Cmd, cpus []int) error {
+	if len(cpus) == 0 {
+		return cmd.Start()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// the thread is left locked, so it exits with the goroutine rather
+		// than running other goroutines with the affinity
+		runtime.LockOSThread()
+		if err := setAffinity(cpus); err != nil {
+			errc <- err
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
+
+// setAffinity pins the calling thread to cpus.
+func setAffinity(cpus []int) error {
+	max := 0
+	for _, c := range cpus {
+		if c > max {
+			max = c
+		}
+	}
+	mask := make([]uint64, max/64+1)
+	for _, c := range cpus {
+		mask[c/64] |= 1 << uint(c%64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+const affinitySupported = false
+
+// startPinned starts cmd, ignoring cpus since setting the affinity isn't
+// supported here.
+func startPinned(cmd *exec.Cmd, cpus []int) error {
+	return cmd.Start()
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// options controls how a single file is converted.
+type options struct {
+	VideoCodec   string `json:"codec"`
+	FrameRate    string `json:"fps"`
+	AudioCodec   string `json:"acodec"`
+	AudioBitrate string `json:"ab"`
+	AudioOnly    bool   `json:"audio_only"`
+	OutExt       string `json:"out_ext"`
+	MatchCase    bool   `json:"match_case"`
+	Chapters     bool   `json:"chapters"`
+	Verify       bool   `json:"verify"`
+	Keep         bool   `json:"keep"`
+	Threads      int    `json:"threads"`
+	LogLevel     string `json:"ffmpeg_loglevel"`
+	InputArgs    string `json:"input_args"`
+	FFmpegArgs   string `json:"ffmpeg_args"`
+
+	TranscodeMissing bool   `json:"transcode_missing"`
+	ValidateInput    string `json:"validate_input"`
+	FixSync          string `json:"fix_sync"`
+	CopyTS           bool   `json:"copyts"`
+	StartAtZero      bool   `json:"start_at_zero"`
+	KeepLangs        string `json:"keep_langs"`
+	UntaggedLangs    string `json:"untagged_langs"`
+	Cover            string `json:"cover"`
+	PreserveAll      bool   `json:"preserve_all"`
+	HDR              bool   `json:"hdr"`
+	Deinterlace      bool   `json:"deinterlace_if_needed"`
+	LUT              string `json:"lut"`
+	TargetSize       string `json:"target_size"`
+	HWAccel          string `json:"hwaccel"`
+	HWAccelDevices   string `json:"hwaccel_device"`
+	Compat           string `json:"compat"`
+	RequireVideo     bool   `json:"require_video"`
+	RequireAudio     bool   `json:"require_audio"`
+
+	Faststart  bool `json:"faststart"`
+	Fragmented bool `json:"fragmented"`
+
+	PreservePerms bool `json:"preserve_perms"`
+	PreserveTime  bool `json:"preserve_time"`
+	Touch         bool `json:"touch"`
+	Stdout        bool `json:"-"`
+
+	// Rules decide the codec of each stream from ffprobe's output.
+	Rules ruleSet `json:"-"`
+
+	// subtitleCodec is set for the second pass of -transcode-missing.
+	subtitleCodec string
+	// device is the one of HWAccelDevices picked for this conversion.
+	device string
+	// segment is the -segment duration in seconds, splitting the output.
+	segment string
+	// deinterlace is set once the input is found to be interlaced.
+	deinterlace bool
+	// cpus are the CPUs ffmpeg is pinned to with -affinity.
+	cpus []int
+	// format is the -f of the output when it can't be told from its name.
+	format string
+	// concat is set when the input is a concat demuxer list of sources.
+	concat bool
+	// suffix, height and crf are set for a -rendition: the output's name
+	// gets suffix before its extension, and its video is scaled to height
+	// and encoded with crf.
+	suffix string
+	height int
+	crf    string
+	// maxHeight scales down video taller than it, for -proxy.
+	maxHeight int
+	// videoBitrate is the video's bitrate in bits per second picked for
+	// -target-size, encoded in two passes when pass is set, with the first
+	// pass's statistics in passLog.
+	videoBitrate int64
+	pass         int
+	passLog      string
+	// resumeAt is where in the source a -resume of -segment carries on
+	// from, in seconds, writing segments from number segmentStart.
+	resumeAt     string
+	segmentStart int
+	// start and end are set to the chapter's times in seconds with
+	// -split-chapters, converting only that part of the source.
+	start, end string
+	// progress receives the -progress-json events of converting source,
+	// which is duration seconds long.
+	progress *progressStream
+	source   string
+	duration float64
+}
+
+// defaultOptions are the options used when no flags are given.
+var defaultOptions = options{VideoCodec: "copy", Chapters: true, UntaggedLangs: "keep", LogLevel: "error", RequireVideo: true}
+
+// remoteOptions are the JSON names of the options that POST /convert and
+// sidecar files can set, which anyone able to reach the server or write next
+// to a source controls. The others pass raw arguments to ffmpeg or name
+// files, and are only taken from the command line and -batch.
+var remoteOptions = map[string]bool{
+	"codec": true, "fps": true, "acodec": true, "ab": true, "audio_only": true, "out_ext": true, "match_case": true,
+	"chapters": true, "verify": true, "keep": true, "threads": true, "ffmpeg_loglevel": true,
+	"transcode_missing": true, "validate_input": true, "fix_sync": true, "copyts": true, "start_at_zero": true,
+	"keep_langs": true, "untagged_langs": true, "cover": true, "preserve_all": true, "hdr": true,
+	"deinterlace_if_needed": true, "target_size": true, "hwaccel": true, "hwaccel_device": true, "compat": true,
+	"require_video": true, "require_audio": true, "faststart": true, "fragmented": true,
+	"preserve_perms": true, "preserve_time": true, "touch": true,
+}
+
+// decodeRemoteOptions returns opts with the JSON object data applied over
+// it, along with the sorted names it set, failing on names that aren't in
+// remoteOptions.
+func decodeRemoteOptions(data []byte, opts options) (options, []string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return opts, nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !remoteOptions[name] {
+			return opts, nil, fmt.Errorf("%q isn't an option that can be set here", name)
+		}
+	}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return opts, nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return opts, nil, err
+	}
+	return opts, names, nil
+}
+
+// registerFlags defines a flag on fs for each option of a single file's
+// conversion, defaulting to o's current values.
+func (o *options) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.VideoCodec, "codec", o.VideoCodec, "video codec")
+	fs.StringVar(&o.FrameRate, "fps", o.FrameRate, "output frame rate, e.g. 30 or 30000/1001 (requires re-encoding)")
+	fs.StringVar(&o.AudioCodec, "acodec", o.AudioCodec, "audio codec (default copy)")
+	fs.StringVar(&o.AudioBitrate, "ab", o.AudioBitrate, "audio bitrate, e.g. 192k (ignored when audio is copied)")
+	fs.BoolVar(&o.AudioOnly, "audio-only", o.AudioOnly, "extract only the audio streams")
+	fs.StringVar(&o.OutExt, "out-ext", o.OutExt, "output file extension (default .mp4, or .m4a with -audio-only)")
+	fs.BoolVar(&o.MatchCase, "match-case", o.MatchCase, "give outputs an upper case extension when their source's is, e.g. Movie.MKV to Movie.MP4")
+	fs.BoolVar(&o.Chapters, "chapters", o.Chapters, "copy chapters to the output (-chapters=false strips them)")
+	fs.BoolVar(&o.TranscodeMissing, "transcode-missing", o.TranscodeMissing, "when copying loses or fails on a stream type, convert again transcoding only that type")
+	fs.IntVar(&o.Threads, "threads", o.Threads, "threads used by each ffmpeg process, e.g. -c 4 -threads 2 (default chosen by ffmpeg)")
+	fs.StringVar(&o.LogLevel, "ffmpeg-loglevel", o.LogLevel, "ffmpeg's -loglevel, e.g. error, warning or info")
+	fs.StringVar(&o.InputArgs, "input-args", o.InputArgs, "extra ffmpeg arguments placed before -i, e.g. \"-probesize 100M -analyzeduration 100M\"")
+	fs.StringVar(&o.FFmpegArgs, "ffmpeg-args", o.FFmpegArgs, "extra ffmpeg arguments placed after the other output options, just before the output")
+	fs.StringVar(&o.ValidateInput, "validate-input", o.ValidateInput, "skip sources that appear corrupt, checking their headers with ffprobe (header) or decoding them in full with ffmpeg (full, slow)")
+	fs.StringVar(&o.FixSync, "fix-sync", o.FixSync, "comma separated A/V sync fixes: zero-ts, resample-audio (needs -acodec) and cfr (needs -codec)")
+	fs.BoolVar(&o.CopyTS, "copyts", o.CopyTS, "keep the source's timestamps exactly instead of letting ffmpeg normalize them")
+	fs.BoolVar(&o.StartAtZero, "start-at-zero", o.StartAtZero, "with -copyts, shift the timestamps so the output starts at zero")
+	fs.StringVar(&o.KeepLangs, "keep-langs", o.KeepLangs, "comma separated ISO 639-2 languages of the audio and subtitle streams kept, e.g. eng,jpn (default all)")
+	fs.StringVar(&o.UntaggedLangs, "untagged-langs", o.UntaggedLangs, "keep or drop the audio and subtitle streams without a language with -keep-langs")
+	fs.StringVar(&o.Cover, "cover", o.Cover, "keep embedded cover art as the MP4's cover, or drop it along with other attachments: keep or drop (default left to ffmpeg)")
+	fs.BoolVar(&o.PreserveAll, "preserve-all", o.PreserveAll, "copy every stream with its metadata, dispositions and the chapters, failing on streams MP4 can't hold instead of dropping them")
+	fs.BoolVar(&o.Deinterlace, "deinterlace-if-needed", o.Deinterlace, "detect interlaced sources with ffmpeg's idet filter, deinterlacing and re-encoding only those (with -codec, or libx264 when copying)")
+	fs.StringVar(&o.LUT, "lut", o.LUT, "3D LUT file applied to the video while re-encoding it, e.g. grade.cube (needs -codec)")
+	fs.StringVar(&o.TargetSize, "target-size", o.TargetSize, "re-encode the video at the bitrate fitting each output in this size, e.g. 25M, in two passes where the encoder supports it (with -codec, or libx264 when copying)")
+	fs.StringVar(&o.Compat, "compat", o.Compat, "re-encode for an older device with a known-good preset, e.g. dlna, ps3 or mobile (\"list\" lists them)")
+	fs.BoolVar(&o.HDR, "hdr", o.HDR, "carry HDR color metadata of the source into the output, warning when a copy drops it")
+	fs.StringVar(&o.HWAccel, "hwaccel", o.HWAccel, "hardware acceleration method used to decode, e.g. cuda, qsv or vaapi")
+	fs.StringVar(&o.HWAccelDevices, "hwaccel-device", o.HWAccelDevices, "comma separated -hwaccel devices, e.g. 0,1 or /dev/dri/renderD128; concurrent conversions take turns across them")
+	fs.BoolVar(&o.RequireVideo, "require-video", o.RequireVideo, "skip sources without a video stream, such as audio-only files named .mkv, keeping them (ignored with -audio-only)")
+	fs.BoolVar(&o.RequireAudio, "require-audio", o.RequireAudio, "skip sources without an audio stream, keeping them")
+	fs.BoolVar(&o.Verify, "verify", o.Verify, "check each output with ffprobe before removing its source")
+	fs.BoolVar(&o.Keep, "keep", o.Keep, "keep the sources instead of removing them once converted")
+	fs.BoolVar(&o.Faststart, "faststart", o.Faststart, "move the MP4 index to the start of the file so playback can begin before it's fully downloaded")
+	fs.BoolVar(&o.Fragmented, "fragmented", o.Fragmented, "write fragmented MP4 for DASH/HLS packaging (not supported by some players; can't be used with -faststart)")
+	fs.BoolVar(&o.PreservePerms, "preserve-perms", o.PreservePerms, "give outputs the permissions and, when permitted, the owner of their source")
+	fs.BoolVar(&o.PreserveTime, "preserve-time", o.PreserveTime, "give outputs the modification time of their source")
+	fs.BoolVar(&o.Touch, "touch", o.Touch, "set the modification time of outputs to when their conversion finished, so library scanners see them as new")
+}
+
+// audioExts maps the output extensions accepted by -audio-only to the audio
+// codec used when -acodec isn't set.
+var audioExts = map[string]string{
+	".m4a":  "copy",
+	".aac":  "copy",
+	".mka":  "copy",
+	".mp3":  "libmp3lame",
+	".flac": "flac",
+	".opus": "libopus",
+	".ogg":  "libvorbis",
+	".wav":  "pcm_s16le",
+}
+
+// mp4Exts are the output extensions written by ffmpeg's mov/mp4 muxer, which
+// takes -movflags.
+var mp4Exts = map[string]bool{".mp4": true, ".m4v": true, ".m4a": true, ".mov": true}
+
+// syncFixes are the fixes -fix-sync can apply, by name.
+var syncFixes = map[string][]string{
+	// shift timestamps so none are negative, e.g. audio starting before video
+	"zero-ts": {"-avoid_negative_ts", "make_zero"},
+	// stretch or pad the audio to match its timestamps
+	"resample-audio": {"-af", "aresample=async=1"},
+	// duplicate or drop frames for a constant frame rate
+	"cfr": {"-vsync", "cfr"},
+}
+
+// lutExts are the 3D LUT formats read by ffmpeg's lut3d filter.
+var lutExts = map[string]bool{".cube": true, ".3dl": true, ".dat": true, ".m3d": true, ".csp": true}
+
+// stdoutOutput is the ffmpeg output used with -stdout.
+const stdoutOutput = "pipe:1"
+
+// nullOutput is the ffmpeg output of runs whose output is thrown away, such
+// as the first pass of a two-pass encode.
+const nullOutput = "-"
+
+var (
+	bitrateRE = regexp.MustCompile(`^[1-9][0-9]*[kKmM]?$`)
+	langRE    = regexp.MustCompile(`^[a-z]{3}$`)
+	deviceRE  = regexp.MustCompile(`^([0-9]+|/dev/[\w./-]+)$`)
+)
+
+// logLevels are the names ffmpeg's -loglevel takes.
+var logLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+// hwaccels are the -hwaccel methods ffmpeg supports.
+var hwaccels = []string{"auto", "cuda", "qsv", "vaapi", "videotoolbox", "dxva2", "d3d11va", "vdpau", "drm", "opencl", "vulkan"}
+
+func (o *options) validate() error {
+	if strings.ContainsAny(o.OutExt, `/\`) {
+		return fmt.Errorf("invalid -out-ext %q (expected e.g. .m4v)", o.OutExt)
+	}
+	if o.AudioBitrate != "" && !bitrateRE.MatchString(o.AudioBitrate) {
+		return fmt.Errorf("invalid audio bitrate %q (expected e.g. 128k)", o.AudioBitrate)
+	}
+	if o.CopyTS && o.FixSync != "" {
+		return fmt.Errorf("-copyts and -fix-sync can't be used together")
+	} else if o.StartAtZero && !o.CopyTS {
+		return fmt.Errorf("-start-at-zero requires -copyts")
+	}
+	if o.PreserveTime && o.Touch {
+		return fmt.Errorf("-preserve-time and -touch can't be used together")
+	}
+	if o.ValidateInput != "" && o.ValidateInput != validateHeader && o.ValidateInput != validateFull {
+		return fmt.Errorf("unknown -validate-input %q (expected %s or %s)", o.ValidateInput, validateHeader, validateFull)
+	}
+	for _, fix := range o.syncFixes() {
+		if _, ok := syncFixes[fix]; !ok {
+			return fmt.Errorf("unknown -fix-sync fix %q (expected zero-ts, resample-audio or cfr)", fix)
+		} else if fix == "resample-audio" && (o.audioCopied() || o.Rules != nil) {
+			return fmt.Errorf("-fix-sync resample-audio requires re-encoding audio with -acodec")
+		} else if fix == "cfr" && (o.videoCopied() || o.AudioOnly) {
+			return fmt.Errorf("-fix-sync cfr requires re-encoding video with -codec")
+		}
+	}
+	for _, lang := range o.langs() {
+		if !langRE.MatchString(lang) {
+			return fmt.Errorf("invalid language %q (expected an ISO 639-2 code such as eng)", lang)
+		}
+	}
+	if o.UntaggedLangs != "" && o.UntaggedLangs != "keep" && o.UntaggedLangs != "drop" {
+		return fmt.Errorf("unknown -untagged-langs %q (expected keep or drop)", o.UntaggedLangs)
+	}
+	if o.Cover != "" && o.Cover != "keep" && o.Cover != "drop" {
+		return fmt.Errorf("unknown -cover %q (expected keep or drop)", o.Cover)
+	} else if o.Cover != "" && o.AudioOnly {
+		return fmt.Errorf("-cover can't be used with -audio-only")
+	}
+	if o.InputArgs != "" {
+		if _, err := splitArgs(o.InputArgs); err != nil {
+			return fmt.Errorf("-input-args: %v", err)
+		}
+	}
+	if o.FFmpegArgs != "" {
+		if _, err := splitArgs(o.FFmpegArgs); err != nil {
+			return fmt.Errorf("-ffmpeg-args: %v", err)
+		}
+	}
+	if o.LogLevel != "" && !contains(logLevels, o.LogLevel) {
+		return fmt.Errorf("unknown -ffmpeg-loglevel %q (expected one of %s)", o.LogLevel, strings.Join(logLevels, ", "))
+	}
+	if o.PreserveAll && (o.AudioOnly || o.Rules != nil || o.TranscodeMissing || o.KeepLangs != "" || o.Cover != "") {
+		return fmt.Errorf("-preserve-all can't be combined with -audio-only, -rules, -transcode-missing, -keep-langs or -cover")
+	} else if o.PreserveAll && (!o.videoCopied() || o.AudioCodec != "" || o.Deinterlace || !o.Chapters) {
+		return fmt.Errorf("-preserve-all copies everything and can't be combined with -codec, -acodec, -deinterlace-if-needed or -chapters=false")
+	}
+	if o.LUT != "" {
+		if o.videoCopied() || o.AudioOnly {
+			return fmt.Errorf("-lut requires re-encoding video with -codec")
+		} else if !lutExts[strings.ToLower(filepath.Ext(o.LUT))] {
+			return fmt.Errorf("-lut %s isn't a LUT file (expected .cube, .3dl, .dat, .m3d or .csp)", o.LUT)
+		} else if _, err := os.Stat(o.LUT); err != nil {
+			return fmt.Errorf("-lut: %v", err)
+		}
+	}
+	if o.HDR && o.AudioOnly {
+		return fmt.Errorf("-hdr can't be used with -audio-only")
+	}
+	if o.TargetSize != "" {
+		if n, err := parseSize(o.TargetSize); err != nil || n == 0 {
+			return fmt.Errorf("invalid -target-size %q (expected e.g. 25M)", o.TargetSize)
+		} else if o.AudioOnly || o.PreserveAll {
+			return fmt.Errorf("-target-size can't be combined with -audio-only or -preserve-all")
+		}
+	}
+	if o.Compat != "" {
+		if _, ok := compatPresets[o.Compat]; !ok {
+			return fmt.Errorf("unknown -compat %q (expected one of %s)", o.Compat, strings.Join(compatNames(), ", "))
+		} else if o.AudioOnly || o.PreserveAll || o.Rules != nil || o.Fragmented || o.Stdout {
+			return fmt.Errorf("-compat can't be combined with -audio-only, -preserve-all, -rules, -fragmented or -stdout")
+		}
+	}
+	if o.HWAccel != "" && !contains(hwaccels, o.HWAccel) {
+		return fmt.Errorf("unknown -hwaccel %q (expected one of %s)", o.HWAccel, strings.Join(hwaccels, ", "))
+	}
+	for _, d := range o.devices() {
+		if o.HWAccel == "" {
+			return fmt.Errorf("-hwaccel-device requires -hwaccel")
+		} else if !deviceRE.MatchString(d) {
+			return fmt.Errorf("invalid -hwaccel-device %q (expected a device number or a /dev path)", d)
+		}
+	}
+	if o.Threads < 0 {
+		return fmt.Errorf("-threads can't be negative")
+	}
+	if o.Stdout && (o.AudioOnly || o.Verify || o.PreservePerms) {
+		return fmt.Errorf("-stdout can't be combined with -audio-only, -verify or -preserve-perms")
+	}
+	if o.Faststart && (o.Fragmented || o.Stdout) {
+		return fmt.Errorf("-faststart can't be combined with -fragmented or -stdout")
+	}
+	if (o.Faststart || o.Fragmented || o.Compat != "") && !mp4Exts[o.outputExt()] {
+		return fmt.Errorf("-faststart, -fragmented and -compat need an MP4 output, not %s", o.outputExt())
+	}
+	if o.TranscodeMissing && (o.Rules != nil || o.AudioOnly || o.Stdout) {
+		return fmt.Errorf("-transcode-missing can't be combined with -rules, -audio-only or -stdout")
+	}
+	if o.Rules != nil && (o.AudioOnly || !o.videoCopied() || o.AudioCodec != "") {
+		return fmt.Errorf("-rules can't be combined with -audio-only, -codec or -acodec")
+	}
+	if o.AudioOnly {
+		if _, ok := audioExts[o.outputExt()]; !ok {
+			return fmt.Errorf("%s is not an audio container", o.outputExt())
+		} else if !o.videoCopied() || o.FrameRate != "" {
+			return fmt.Errorf("-codec and -fps can't be used with -audio-only")
+		}
+	}
+	if o.FrameRate != "" {
+		if !validFrameRate(o.FrameRate) {
+			return fmt.Errorf("invalid frame rate %q (expected e.g. 30 or 30000/1001)", o.FrameRate)
+		} else if o.videoCopied() {
+			return fmt.Errorf("-fps requires re-encoding video and can't be used with -codec copy")
+		}
+	}
+	return nil
+}
+
+// validFrameRate accepts a positive number or a rational such as 30000/1001.
+func validFrameRate(s string) bool {
+	parts := strings.Split(s, "/")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, p := range parts {
+		n, err := strconv.ParseFloat(p, 64)
+		if err != nil || n <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// videoCopied reports whether the video streams are copied as-is.
+func (o *options) videoCopied() bool {
+	return o.VideoCodec == "" || o.VideoCodec == "copy"
+}
+
+// audioCodec returns the codec the audio streams are converted with.
+func (o *options) audioCodec() string {
+	if o.AudioCodec != "" {
+		return o.AudioCodec
+	} else if o.AudioOnly && audioExts[o.outputExt()] != "" {
+		return audioExts[o.outputExt()]
+	}
+	return "copy"
+}
+
+// audioCopied reports whether the audio streams are copied as-is.
+func (o *options) audioCopied() bool {
+	return o.audioCodec() == "copy"
+}
+
+// outputExt returns the extension given to converted files.
+func (o *options) outputExt() string {
+	switch {
+	case o.OutExt != "":
+		return "." + strings.TrimPrefix(strings.ToLower(o.OutExt), ".")
+	case o.AudioOnly:
+		return ".m4a"
+	}
+	return ".mp4"
+}
+
+// syncFixes returns the names of the -fix-sync fixes.
+func (o *options) syncFixes() []string {
+	var fixes []string
+	for _, fix := range strings.Split(o.FixSync, ",") {
+		if fix = strings.TrimSpace(fix); fix != "" {
+			fixes = append(fixes, fix)
+		}
+	}
+	return fixes
+}
+
+// langs returns the -keep-langs languages.
+func (o *options) langs() []string {
+	var langs []string
+	for _, lang := range strings.Split(o.KeepLangs, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// isCover reports whether st is cover art, which ffmpeg presents as a video
+// stream holding a single picture.
+func isCover(st probeStream) bool {
+	return st.CodecType == "video" && st.Disposition["attached_pic"] == 1
+}
+
+// keepStream reports whether st is kept by -cover and -keep-langs. Only
+// audio and subtitle streams are filtered by language.
+func (o *options) keepStream(st probeStream) bool {
+	if o.Cover == "drop" && (isCover(st) || st.CodecType == "attachment") {
+		return false
+	}
+	if o.KeepLangs == "" || (st.CodecType != "audio" && st.CodecType != "subtitle") {
+		return true
+	}
+	lang := st.Tags["language"]
+	if lang == "" || lang == "und" {
+		return o.UntaggedLangs != "drop"
+	}
+	return contains(o.langs(), lang)
+}
+
+// keptStreams returns a copy of p holding only the streams kept by -cover
+// and -keep-langs.
+func (o *options) keptStreams(p *probeResult) *probeResult {
+	if (o.KeepLangs == "" && o.Cover != "drop") || p == nil {
+		return p
+	}
+	kept := *p
+	kept.Streams = nil
+	for _, st := range p.Streams {
+		if o.keepStream(st) {
+			kept.Streams = append(kept.Streams, st)
+		}
+	}
+	return &kept
+}
+
+// missingLangs returns the -keep-langs languages that none of the audio or
+// subtitle streams of p are in.
+func (o *options) missingLangs(p *probeResult) []string {
+	var missing []string
+	for _, lang := range o.langs() {
+		found := false
+		for _, st := range p.Streams {
+			if (st.CodecType == "audio" || st.CodecType == "subtitle") && st.Tags["language"] == lang {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, lang)
+		}
+	}
+	return missing
+}
+
+// devices returns the -hwaccel-device devices.
+func (o *options) devices() []string {
+	var devices []string
+	for _, d := range strings.Split(o.HWAccelDevices, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// deviceFor returns the device used by the worker with the given ID, so
+// that concurrent conversions are spread across the devices.
+func (o *options) deviceFor(worker int) string {
+	devices := o.devices()
+	if len(devices) == 0 {
+		return ""
+	}
+	return devices[(worker-1)%len(devices)]
+}
+
+// needsProbe reports whether building the arguments requires ffprobe's
+// output for the input.
+func (o *options) needsProbe() bool {
+	return o.Rules != nil || o.TranscodeMissing || o.KeepLangs != "" || o.Cover != "" || o.HDR || o.PreserveAll || o.TargetSize != ""
+}
+
+// ffmpegArgs builds the ffmpeg arguments converting input into output. p is
+// the input's ffprobe output, which may be nil unless o.needsProbe().
+func ffmpegArgs(o options, p *probeResult, input, output string) []string {
+	var args []string
+	if o.LogLevel != "" {
+		args = append(args, "-loglevel", o.LogLevel)
+	}
+	if o.HWAccel != "" {
+		args = append(args, "-hwaccel", o.HWAccel)
+		if o.device != "" {
+			args = append(args, "-hwaccel_device", o.device)
+		}
+	}
+	if o.concat {
+		args = append(args, "-f", "concat", "-safe", "0")
+	}
+	// validate already checked these split
+	inputArgs, _ := splitArgs(o.InputArgs)
+	args = append(args, inputArgs...)
+	if o.end != "" {
+		args = append(args, "-ss", o.start, "-to", o.end)
+	} else if o.resumeAt != "" {
+		args = append(args, "-ss", o.resumeAt)
+	}
+	args = append(args, "-i", input)
+	p = o.keptStreams(p)
+	var mapped []probeStream // the streams mapped by index, in output order
+	switch {
+	case o.AudioOnly && o.KeepLangs != "" && p != nil:
+		mapped = p.streams("audio")
+		args = append(args, mapArgs(mapped)...)
+		args = append(args, "-vn", "-sn", "-dn")
+	case o.AudioOnly:
+		args = append(args, "-map", "0:a", "-vn", "-sn", "-dn")
+	case o.PreserveAll && p != nil:
+		args = append(args, preserveArgs(p)...)
+	case o.Rules != nil && p != nil:
+		mapped = o.Rules.mapped(p)
+		args = append(args, o.Rules.streamArgs(p)...)
+	case (o.KeepLangs != "" || o.Cover != "") && p != nil:
+		for _, st := range p.Streams {
+			if st.CodecType == "video" || st.CodecType == "audio" || st.CodecType == "subtitle" {
+				mapped = append(mapped, st)
+			}
+		}
+		args = append(args, mapArgs(mapped)...)
+		args = append(args, "-codec", "copy")
+	default:
+		args = append(args, "-codec", "copy")
+	}
+	if !o.videoCopied() {
+		args = append(args, "-c:v", o.VideoCodec)
+		if filters := o.videoFilters(); len(filters) > 0 {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+		if o.crf != "" {
+			args = append(args, "-crf", o.crf)
+		}
+		if o.videoBitrate > 0 {
+			args = append(args, "-b:v", strconv.FormatInt(o.videoBitrate, 10))
+		}
+		if o.pass > 0 {
+			args = append(args, "-pass", strconv.Itoa(o.pass), "-passlogfile", o.passLog)
+		}
+		if strings.HasSuffix(o.VideoCodec, "_nvenc") && o.device != "" && !strings.HasPrefix(o.device, "/") {
+			// NVENC picks its GPU separately from the decoder
+			args = append(args, "-gpu", o.device)
+		}
+	}
+	if o.HDR && p != nil {
+		args = append(args, o.hdrArgs(p)...)
+	}
+	if o.FrameRate != "" {
+		args = append(args, "-r", o.FrameRate)
+	}
+	if o.AudioOnly || o.AudioCodec != "" {
+		args = append(args, "-c:a", o.audioCodec())
+	}
+	if o.AudioBitrate != "" && !o.audioCopied() {
+		args = append(args, "-b:a", o.AudioBitrate)
+	}
+	if o.subtitleCodec != "" {
+		args = append(args, "-c:s", o.subtitleCodec)
+	}
+	if o.Compat != "" {
+		args = append(args, compatPresets[o.Compat].args...)
+	}
+	if o.Cover == "keep" {
+		args = append(args, coverArgs(mapped)...)
+	}
+	for _, fix := range o.syncFixes() {
+		args = append(args, syncFixes[fix]...)
+	}
+	if o.CopyTS {
+		args = append(args, "-copyts")
+		if o.StartAtZero {
+			args = append(args, "-start_at_zero")
+		}
+	}
+	if o.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(o.Threads))
+	}
+	if o.Chapters {
+		args = append(args, "-map_chapters", "0")
+	} else {
+		args = append(args, "-map_chapters", "-1")
+	}
+	if o.pass == 1 {
+		// the first pass only needs the video's statistics
+		extraArgs, _ := splitArgs(o.FFmpegArgs)
+		args = append(args, extraArgs...)
+		return append(args, "-an", "-sn", "-dn", "-f", "null", output)
+	}
+	if output == stdoutOutput {
+		args = append(args, "-f", "mp4")
+	} else if o.format != "" && o.segment == "" {
+		args = append(args, "-f", o.format)
+	}
+	flags := o.movflags(output == stdoutOutput)
+	if o.segment != "" {
+		args = append(args, "-f", "segment", "-segment_time", o.segment, "-reset_timestamps", "1")
+		if o.segmentStart > 0 {
+			args = append(args, "-segment_start_number", strconv.Itoa(o.segmentStart))
+		}
+		if len(flags) > 0 {
+			// the segment muxer passes these on to the mp4 muxer of each segment
+			args = append(args, "-segment_format_options", "movflags=+"+strings.Join(flags, "+"))
+		}
+	} else if len(flags) > 0 {
+		args = append(args, "-movflags", strings.Join(flags, "+"))
+	}
+	extraArgs, _ := splitArgs(o.FFmpegArgs)
+	args = append(args, extraArgs...)
+	return append(args, output)
+}
+
+// mapArgs returns the -map arguments selecting streams.
+func mapArgs(streams []probeStream) []string {
+	var args []string
+	for _, st := range streams {
+		args = append(args, "-map", "0:"+strconv.Itoa(st.Index))
+	}
+	return args
+}
+
+// coverArgs returns the arguments copying the cover art among the mapped
+// streams and marking it as the MP4's cover.
+func coverArgs(mapped []probeStream) []string {
+	var args []string
+	for i, st := range mapped {
+		if isCover(st) {
+			n := strconv.Itoa(i)
+			args = append(args, "-c:"+n, "copy", "-disposition:"+n, "attached_pic")
+		}
+	}
+	return args
+}
+
+// movflags returns the mp4 muxer flags needed by o, merged so that every
+// option setting them is kept.
+func (o *options) movflags(pipe bool) []string {
+	var flags []string
+	add := func(fs ...string) {
+		for _, f := range fs {
+			if !contains(flags, f) {
+				flags = append(flags, f)
+			}
+		}
+	}
+	if o.Faststart {
+		add("faststart")
+	}
+	if pipe {
+		// a pipe isn't seekable, so the moov atom has to come first
+		add("frag_keyframe", "empty_moov")
+	}
+	if o.Fragmented {
+		add("frag_keyframe", "empty_moov", "default_base_moof")
+	}
+	add(compatPresets[o.Compat].movflags...)
+	return flags
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// videoFilters returns the filters of the -vf chain applied to re-encoded
+// video, in the order they're applied.
+func (o *options) videoFilters() []string {
+	var filters []string
+	if o.deinterlace {
+		filters = append(filters, "yadif")
+	}
+	if o.height > 0 {
+		// -2 keeps the aspect ratio with an even width, which most encoders need
+		filters = append(filters, fmt.Sprintf("scale=-2:%d", o.height))
+	} else if h := o.scaleLimit(); h > 0 {
+		filters = append(filters, compatScale(h))
+	}
+	if o.LUT != "" {
+		filters = append(filters, "lut3d=file="+escapeFilterValue(o.LUT))
+	}
+	return filters
+}
+
+// escapeFilterValue escapes s for use as an option value in a filter graph,
+// such as a file name holding colons, commas or quotes. ffmpeg unescapes
+// values twice, once when parsing the graph and again when parsing the
+// filter's options, so both levels of escaping are applied.
+func escapeFilterValue(s string) string {
+	return escapeChars(escapeChars(s, `\':`), `\'[],;`)
+}
+
+// escapeChars puts a backslash before each of chars in s.
+func escapeChars(s, chars string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// argIndex returns the index of arg in args, or -1 if it isn't there.
+func argIndex(args []string, arg string) int {
+	for i, a := range args {
+		if a == arg {
+			return i
+		}
+	}
+	return -1
+}
+
+// argValue returns the argument following flag in args.
+func argValue(args []string, flag string) (string, bool) {
+	if i := argIndex(args, flag); i >= 0 && i+1 < len(args) {
+		return args[i+1], true
+	}
+	return "", false
+}
+
+func TestFFmpegArgsThreads(t *testing.T) {
+	tests := []struct {
+		threads int
+		want    string // "" for no -threads
+	}{
+		{0, ""},
+		{1, "1"},
+		{4, "4"},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.Threads = tt.threads
+		args := ffmpegArgs(opts, nil, "in.mkv", "out.mp4")
+		got, ok := argValue(args, "-threads")
+		if tt.want == "" {
+			if ok {
+				t.Errorf("threads %d: got -threads %s, want none in %q", tt.threads, got, args)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("threads %d: got -threads %q, want %q in %q", tt.threads, got, tt.want, args)
+		}
+		// -threads is an output option, so it has to come after the input
+		if argIndex(args, "-threads") < argIndex(args, "-i") {
+			t.Errorf("threads %d: -threads comes before -i in %q", tt.threads, args)
+		}
+	}
+}
+
+func TestFFmpegArgsDefault(t *testing.T) {
+	got := ffmpegArgs(defaultOptions, nil, "in.mkv", "out.mp4")
+	want := []string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-map_chapters", "0", "out.mp4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ffmpegArgs = %q, want %q", got, want)
+	}
+}
+
+func TestFFmpegArgsPassthrough(t *testing.T) {
+	tests := []struct {
+		name                  string
+		inputArgs, ffmpegArgs string
+		want                  []string
+	}{
+		{"none", "", "",
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-map_chapters", "0", "out.mp4"}},
+		{"input args", "-analyzeduration 100M -fflags +genpts", "",
+			[]string{"-loglevel", "error", "-analyzeduration", "100M", "-fflags", "+genpts", "-i", "in.mkv", "-codec", "copy", "-map_chapters", "0", "out.mp4"}},
+		{"ffmpeg args", "", "-metadata 'title=A Movie'",
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-map_chapters", "0", "-metadata", "title=A Movie", "out.mp4"}},
+		{"both", "-probesize 50M", "-max_muxing_queue_size 1024",
+			[]string{"-loglevel", "error", "-probesize", "50M", "-i", "in.mkv", "-codec", "copy", "-map_chapters", "0", "-max_muxing_queue_size", "1024", "out.mp4"}},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.InputArgs, opts.FFmpegArgs = tt.inputArgs, tt.ffmpegArgs
+		if err := opts.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := ffmpegArgs(opts, nil, "in.mkv", "out.mp4"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ffmpegArgs = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFFmpegArgsPassthroughFirstPass(t *testing.T) {
+	opts := defaultOptions
+	opts.VideoCodec, opts.FFmpegArgs = "libx264", "-preset slow"
+	opts.pass, opts.passLog, opts.videoBitrate = 1, "pass", 1000000
+	args := ffmpegArgs(opts, nil, "in.mkv", "out.mp4")
+	if got, _ := argValue(args, "-preset"); got != "slow" {
+		t.Errorf("first pass dropped -ffmpeg-args: %q", args)
+	} else if argIndex(args, "-preset") > argIndex(args, "-an") {
+		t.Errorf("first pass puts -ffmpeg-args after its own output options: %q", args)
+	}
+}
+
+func TestValidatePassthrough(t *testing.T) {
+	tests := []struct {
+		inputArgs, ffmpegArgs string
+		ok                    bool
+	}{
+		{"-probesize 50M", "-preset slow", true},
+		{`-metadata "title=unterminated`, "", false},
+		{"", `-metadata 'title=unterminated`, false},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.InputArgs, opts.FFmpegArgs = tt.inputArgs, tt.ffmpegArgs
+		if err := opts.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(-input-args %q, -ffmpeg-args %q) = %v, want ok %v", tt.inputArgs, tt.ffmpegArgs, err, tt.ok)
+		}
+	}
+}
+
+func TestFFmpegArgsCopyTS(t *testing.T) {
+	tests := []struct {
+		name                string
+		copyTS, startAtZero bool
+		want                []string
+	}{
+		{"off", false, false,
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-map_chapters", "0", "out.mp4"}},
+		{"copyts", true, false,
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-copyts", "-map_chapters", "0", "out.mp4"}},
+		{"copyts from zero", true, true,
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-copyts", "-start_at_zero", "-map_chapters", "0", "out.mp4"}},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.CopyTS, opts.StartAtZero = tt.copyTS, tt.startAtZero
+		if err := opts.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := ffmpegArgs(opts, nil, "in.mkv", "out.mp4"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ffmpegArgs = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCopyTS(t *testing.T) {
+	tests := []struct {
+		copyTS, startAtZero bool
+		fixSync             string
+		ok                  bool
+	}{
+		{true, false, "", true},
+		{true, true, "", true},
+		{false, false, "zero-ts", true},
+		{true, false, "zero-ts", false},
+		{true, true, "zero-ts", false},
+		{false, true, "", false},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.CopyTS, opts.StartAtZero, opts.FixSync = tt.copyTS, tt.startAtZero, tt.fixSync
+		if err := opts.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(-copyts=%v -start-at-zero=%v -fix-sync %q) = %v, want ok %v",
+				tt.copyTS, tt.startAtZero, tt.fixSync, err, tt.ok)
+		}
+	}
+}
+
+// coverProbe is ffprobe's output for an MKV with a poster attached as a
+// picture and a font attachment for its subtitles.
+const coverProbe = `{
+	"streams": [
+		{
+			"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080,
+			"disposition": {"default": 1, "attached_pic": 0}
+		},
+		{
+			"index": 1, "codec_name": "aac", "codec_type": "audio",
+			"disposition": {"default": 1, "attached_pic": 0}, "tags": {"language": "eng"}
+		},
+		{
+			"index": 2, "codec_name": "subrip", "codec_type": "subtitle",
+			"disposition": {"default": 0, "attached_pic": 0}, "tags": {"language": "eng"}
+		},
+		{
+			"index": 3, "codec_name": "mjpeg", "codec_type": "video", "width": 600, "height": 900,
+			"disposition": {"default": 0, "attached_pic": 1},
+			"tags": {"filename": "cover.jpg", "mimetype": "image/jpeg"}
+		},
+		{
+			"index": 4, "codec_name": "ttf", "codec_type": "attachment",
+			"disposition": {"default": 0, "attached_pic": 0},
+			"tags": {"filename": "font.ttf", "mimetype": "application/x-truetype-font"}
+		}
+	]
+}`
+
+func parseProbe(t *testing.T, s string) *probeResult {
+	t.Helper()
+	var p probeResult
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+func TestCoverClassification(t *testing.T) {
+	p := parseProbe(t, coverProbe)
+	drop := defaultOptions
+	drop.Cover = "drop"
+	keep := defaultOptions
+	keep.Cover = "keep"
+	tests := []struct {
+		cover, keptByDrop, keptByKeep bool
+	}{
+		{false, true, true},  // h264
+		{false, true, true},  // aac
+		{false, true, true},  // subrip
+		{true, false, true},  // mjpeg poster
+		{false, false, true}, // ttf font
+	}
+	for i, tt := range tests {
+		st := p.Streams[i]
+		if got := isCover(st); got != tt.cover {
+			t.Errorf("isCover(stream %d, %s) = %v, want %v", i, st.CodecName, got, tt.cover)
+		}
+		if got := drop.keepStream(st); got != tt.keptByDrop {
+			t.Errorf("-cover drop keeps stream %d, %s: %v, want %v", i, st.CodecName, got, tt.keptByDrop)
+		}
+		if got := keep.keepStream(st); got != tt.keptByKeep {
+			t.Errorf("-cover keep keeps stream %d, %s: %v, want %v", i, st.CodecName, got, tt.keptByKeep)
+		}
+	}
+}
+
+// argValues returns the argument following each flag in args.
+func argValues(args []string, flag string) []string {
+	var values []string
+	for i, a := range args {
+		if a == flag && i+1 < len(args) {
+			values = append(values, args[i+1])
+		}
+	}
+	return values
+}
+
+func TestFFmpegArgsCover(t *testing.T) {
+	p := parseProbe(t, coverProbe)
+	tests := []struct {
+		cover string
+		maps  []string
+		// the output stream marked as the cover, "" for none
+		disposition string
+	}{
+		// the poster is the fourth stream mapped, so output stream 3
+		{"keep", []string{"0:0", "0:1", "0:2", "0:3"}, "3"},
+		{"drop", []string{"0:0", "0:1", "0:2"}, ""},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.Cover = tt.cover
+		if err := opts.validate(); err != nil {
+			t.Fatalf("-cover %s: %v", tt.cover, err)
+		}
+		args := ffmpegArgs(opts, p, "in.mkv", "out.mp4")
+		if got := argValues(args, "-map"); !reflect.DeepEqual(got, tt.maps) {
+			t.Errorf("-cover %s: maps %q, want %q, in %q", tt.cover, got, tt.maps, args)
+		}
+		if tt.disposition == "" {
+			for _, a := range args {
+				if strings.HasPrefix(a, "-disposition") {
+					t.Errorf("-cover %s: marks a cover with %s in %q", tt.cover, a, args)
+				}
+			}
+			continue
+		}
+		n := tt.disposition
+		if got, _ := argValue(args, "-disposition:"+n); got != "attached_pic" {
+			t.Errorf("-cover %s: -disposition:%s %q, want attached_pic, in %q", tt.cover, n, got, args)
+		}
+		if got, _ := argValue(args, "-c:"+n); got != "copy" {
+			t.Errorf("-cover %s: -c:%s %q, want copy, in %q", tt.cover, n, got, args)
+		}
+	}
+}
+
+func TestVideoFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(*options)
+		want string // the -vf chain, "" for none
+	}{
+		{"copied", func(o *options) { o.deinterlace, o.LUT = true, "grade.cube" }, ""},
+		{"no filters", func(o *options) { o.VideoCodec = "libx264" }, ""},
+		{"deinterlace", func(o *options) { o.VideoCodec, o.deinterlace = "libx264", true }, "yadif"},
+		{"lut", func(o *options) { o.VideoCodec, o.LUT = "libx264", "grade.cube" }, "lut3d=file=grade.cube"},
+		{"rendition height", func(o *options) { o.VideoCodec, o.height = "libx264", 720 }, "scale=-2:720"},
+		{"proxy height", func(o *options) { o.VideoCodec, o.maxHeight = "libx264", 720 }, `scale=-2:min(720\,ih)`},
+		{"everything", func(o *options) {
+			o.VideoCodec, o.deinterlace, o.height, o.LUT = "libx264", true, 1080, "/luts/grade.cube"
+		}, "yadif,scale=-2:1080,lut3d=file=/luts/grade.cube"},
+		{"everything scaled down", func(o *options) {
+			o.VideoCodec, o.deinterlace, o.maxHeight, o.LUT = "libx264", true, 480, "grade.cube"
+		}, `yadif,scale=-2:min(480\,ih),lut3d=file=grade.cube`},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		tt.opts(&opts)
+		args := ffmpegArgs(opts, nil, "in.mkv", "out.mp4")
+		got, _ := argValue(args, "-vf")
+		if got != tt.want {
+			t.Errorf("%s: -vf %q, want %q", tt.name, got, tt.want)
+		}
+		if n := count(args, "-vf"); n > 1 {
+			t.Errorf("%s: %d -vf chains in %q, want one", tt.name, n, args)
+		}
+	}
+}
+
+func count(list []string, s string) int {
+	n := 0
+	for _, v := range list {
+		if v == s {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"grade.cube", "grade.cube"},
+		{"/luts/my grade.cube", "/luts/my grade.cube"},
+		{"a,b.cube", `a\,b.cube`},
+		{"a;b.cube", `a\;b.cube`},
+		{"[1].cube", `\[1\].cube`},
+		// escaped for the filter's option parser, then again for the graph's
+		{"x:y.cube", `x\\:y.cube`},
+		{"it's.cube", `it\\\'s.cube`},
+		{`C:\luts\a.cube`, `C\\:\\\\luts\\\\a.cube`},
+	}
+	for _, tt := range tests {
+		if got := escapeFilterValue(tt.in); got != tt.want {
+			t.Errorf("escapeFilterValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateLUT(t *testing.T) {
+	dir := t.TempDir()
+	lut := filepath.Join(dir, "grade.cube")
+	if err := ioutil.WriteFile(lut, []byte("LUT_3D_SIZE 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, codec, lut string
+		ok               bool
+	}{
+		{"re-encoded", "libx264", lut, true},
+		{"copied", "copy", lut, false},
+		{"missing", "libx264", filepath.Join(dir, "missing.cube"), false},
+		{"not a LUT", "libx264", filepath.Join(dir, "grade.png"), false},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.VideoCodec, opts.LUT = tt.codec, tt.lut
+		if err := opts.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
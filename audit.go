@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// The states of a source reported by -audit.
+const (
+	auditNeeded    = "needs conversion" // it has no output yet
+	auditConverted = "converted"        // its output is at least as new
+	auditStale     = "stale"            // it changed after its output was written
+)
+
+type auditEntry struct {
+	Source string `json:"source"`
+	Output string `json:"output"`
+	Status string `json:"status"`
+}
+
+// audit reports the state of each of files, with outputs named by w the
+// way its conversion would name them. Outputs are compared by modification
+// time like -incremental does.
+func (w *worker) audit(files []string, opts options) []auditEntry {
+	var entries []auditEntry
+	for _, f := range files {
+		o := opts
+		if withSidecar, _, err := applySidecar(f, opts); err == nil {
+			o = withSidecar
+		}
+		out := w.outputPath(f, o)
+		e := auditEntry{Source: f, Output: out, Status: auditNeeded}
+		existing := out
+		if w.segment != "" {
+			existing = firstSegment(out)
+		}
+		if outInfo, err := os.Stat(existing); err == nil {
+			e.Status = auditConverted
+			if srcInfo, err := os.Stat(f); err == nil && srcInfo.ModTime().After(outInfo.ModTime()) {
+				e.Status = auditStale
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// writeAudit writes entries to out as a table followed by their totals, or
+// as JSON when format is "json".
+func writeAudit(entries []auditEntry, format string, out io.Writer) error {
+	if format == "json" {
+		if entries == nil {
+			entries = []auditEntry{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	counts := make(map[string]int)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tSOURCE\tOUTPUT")
+	for _, e := range entries {
+		counts[e.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Status, e.Source, e.Output)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d need conversion, %d converted, %d stale\n",
+		counts[auditNeeded], counts[auditConverted], counts[auditStale])
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// A batch file lists the files to convert, one per line, each optionally
+// followed by flags overriding the conversion options for that file:
+//
+//	/videos/a.mkv
+//	"/videos/with spaces.mkv" -acodec aac -ab 192k
+//	/videos/b.mkv -codec libx264 -chapters=false
+//
+// Arguments are split on whitespace, and quotes or a backslash keep it in an
+// argument. Blank lines and lines starting with # are ignored.
+type batchEntry struct {
+	line   int
+	source string
+	opts   options
+	err    error // why the line is invalid
+}
+
+// readBatch parses the batch file r, applying each line's flags over
+// defaults. A line that doesn't parse is returned with its error, and the
+// rest are still read.
+func readBatch(r io.Reader, defaults options) ([]batchEntry, error) {
+	var entries []batchEntry
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseBatchLine(line, defaults)
+		e.line, e.err = n, err
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+func parseBatchLine(line string, defaults options) (batchEntry, error) {
+	args, err := splitArgs(line)
+	if err != nil {
+		return batchEntry{}, err
+	}
+
+	e := batchEntry{source: args[0], opts: defaults}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	e.opts.registerFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return e, err
+	} else if fs.NArg() > 0 {
+		return e, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return e, e.opts.validate()
+}
+
+// splitArgs splits s into arguments the way a shell would, honouring single
+// and double quotes and backslash escapes.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	} else if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no arguments")
+	}
+	return args, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// part is one of several outputs converted from the same source, such as a
+// -rendition or a chapter with -split-chapters.
+type part struct {
+	name string // for errors, e.g. rendition 720p
+	opts options
+}
+
+// chapterParts returns a part converting each of chapters on its own, named
+// after the source with " - " and the chapter's title appended, e.g.
+// "movie - Opening.mp4". Chapters without a title are numbered instead.
+func chapterParts(chapters []probeChapter, opts options) []part {
+	parts := make([]part, 0, len(chapters))
+	used := make(map[string]bool)
+	for i, c := range chapters {
+		title := sanitizeTitle(c.Tags["title"])
+		if title == "" {
+			title = fmt.Sprintf("Chapter %02d", i+1)
+		}
+		name := title
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)", title, n)
+		}
+		used[strings.ToLower(name)] = true
+
+		o := opts
+		o.suffix = " - " + name
+		o.start, o.end = c.StartTime, c.EndTime
+		// the source's chapters don't line up with a part of it
+		o.Chapters = false
+		parts = append(parts, part{name: fmt.Sprintf("chapter %d", i+1), opts: o})
+	}
+	return parts
+}
+
+// clipDuration returns how many seconds of the source o converts, or 0 when
+// it converts the whole source.
+func (o options) clipDuration() float64 {
+	if o.end == "" {
+		return 0
+	}
+	start, _ := strconv.ParseFloat(o.start, 64)
+	end, _ := strconv.ParseFloat(o.end, 64)
+	return end - start
+}
+
+// maxTitleLen is the most characters of a chapter title kept in a name, so
+// names stay well under the usual limit of 255 bytes.
+const maxTitleLen = 100
+
+// sanitizeTitle makes a chapter title safe to use in a file name on any of
+// the supported systems, replacing the characters some of them reserve and
+// trimming the spaces and dots Windows drops.
+func sanitizeTitle(title string) string {
+	var b strings.Builder
+	for _, r := range title {
+		switch {
+		case strings.ContainsRune(`/\:*?"<>|`, r), unicode.IsControl(r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name := []rune(strings.Trim(b.String(), " ."))
+	if len(name) > maxTitleLen {
+		name = []rune(strings.TrimRight(string(name[:maxTitleLen]), " ."))
+	}
+	return string(name)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// compatPreset is a set of output options known to play on a kind of device
+// that handles only part of what MP4 can hold. The video and audio are
+// re-encoded to meet it.
+type compatPreset struct {
+	description string
+	args        []string // output options, placed before -ffmpeg-args
+	movflags    []string
+	maxHeight   int // scale taller video down to this, or 0 to keep it
+}
+
+// stereo keeps the audio to two channels, since many older players can't
+// down-mix AAC 5.1.
+var stereo = []string{"-ac", "2"}
+
+// compatPresets are the -compat presets, by name.
+var compatPresets = map[string]compatPreset{
+	"dlna": {
+		description: "DLNA/UPnP renderers such as smart TVs",
+		args:        append([]string{"-pix_fmt", "yuv420p", "-profile:v", "high", "-level:v", "4.1"}, stereo...),
+		movflags:    []string{"faststart"},
+		maxHeight:   1080,
+	},
+	"ps3": {
+		description: "PlayStation 3",
+		args:        append([]string{"-pix_fmt", "yuv420p", "-profile:v", "high", "-level:v", "4.1"}, stereo...),
+		movflags:    []string{"faststart"},
+		maxHeight:   1080,
+	},
+	"xbox360": {
+		description: "Xbox 360",
+		args:        append([]string{"-pix_fmt", "yuv420p", "-profile:v", "main", "-level:v", "4.1"}, stereo...),
+		movflags:    []string{"faststart"},
+		maxHeight:   1080,
+	},
+	"appletv": {
+		description: "Apple TV 2nd and 3rd generation",
+		args:        append([]string{"-pix_fmt", "yuv420p", "-profile:v", "high", "-level:v", "4.0"}, stereo...),
+		movflags:    []string{"faststart"},
+		maxHeight:   1080,
+	},
+	"mobile": {
+		description: "old phones and tablets",
+		args:        append([]string{"-pix_fmt", "yuv420p", "-profile:v", "baseline", "-level:v", "3.0"}, stereo...),
+		movflags:    []string{"faststart"},
+		maxHeight:   480,
+	},
+}
+
+// compatList is the -compat value listing the presets.
+const compatList = "list"
+
+// compatNames returns the names of the presets, sorted.
+func compatNames() []string {
+	var names []string
+	for name := range compatPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeCompatPresets writes each preset's name, what it's for and the
+// arguments it adds, for -compat list.
+func writeCompatPresets(w io.Writer) {
+	for _, name := range compatNames() {
+		p := compatPresets[name]
+		fmt.Fprintf(w, "%-8s  %s\n", name, p.description)
+		args := append([]string{"-c:v", transcodeCodecs["video"], "-c:a", transcodeCodecs["audio"]}, p.args...)
+		if p.maxHeight > 0 {
+			args = append(args, "-vf", compatScale(p.maxHeight))
+		}
+		args = append(args, "-movflags", strings.Join(p.movflags, "+"))
+		fmt.Fprintf(w, "          %s\n", shellJoin(args))
+	}
+}
+
+// compatScale returns the filter scaling video taller than height down to
+// it, keeping the aspect ratio.
+func compatScale(height int) string {
+	return fmt.Sprintf(`scale=-2:min(%d\,ih)`, height)
+}
+
+// withCompat returns o set up for its -compat preset: the video and audio
+// are re-encoded, with -codec and -acodec or libx264 and AAC by default.
+func (o options) withCompat() options {
+	if o.Compat == "" {
+		return o
+	}
+	if o.videoCopied() {
+		o.VideoCodec = transcodeCodecs["video"]
+	}
+	if o.audioCopied() {
+		o.AudioCodec = transcodeCodecs["audio"]
+	}
+	return o
+}
+
+// scaleLimit returns the height taller video is scaled down to, the lower of
+// the -compat preset's and maxHeight, or 0 for none.
+func (o *options) scaleLimit() int {
+	h := o.maxHeight
+	if c := compatPresets[o.Compat].maxHeight; c > 0 && (h == 0 || c < h) {
+		h = c
+	}
+	return h
+}
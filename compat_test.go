@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFFmpegArgsCompat(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(*options)
+		want []string
+	}{
+		{"dlna", func(o *options) { o.Compat = "dlna" }, []string{
+			"-loglevel", "error", "-i", "in.mkv", "-codec", "copy",
+			"-c:v", "libx264", "-vf", `scale=-2:min(1080\,ih)`, "-c:a", "aac",
+			"-pix_fmt", "yuv420p", "-profile:v", "high", "-level:v", "4.1", "-ac", "2",
+			"-map_chapters", "0", "-movflags", "faststart", "out.mp4",
+		}},
+		{"mobile with -codec and -ab", func(o *options) { o.Compat, o.VideoCodec, o.AudioBitrate = "mobile", "libopenh264", "96k" }, []string{
+			"-loglevel", "error", "-i", "in.mkv", "-codec", "copy",
+			"-c:v", "libopenh264", "-vf", `scale=-2:min(480\,ih)`, "-c:a", "aac", "-b:a", "96k",
+			"-pix_fmt", "yuv420p", "-profile:v", "baseline", "-level:v", "3.0", "-ac", "2",
+			"-map_chapters", "0", "-movflags", "faststart", "out.mp4",
+		}},
+		// -ffmpeg-args come last, so they override the preset
+		{"-ffmpeg-args override", func(o *options) { o.Compat, o.FFmpegArgs, o.Faststart = "xbox360", "-ac 6", true }, []string{
+			"-loglevel", "error", "-i", "in.mkv", "-codec", "copy",
+			"-c:v", "libx264", "-vf", `scale=-2:min(1080\,ih)`, "-c:a", "aac",
+			"-pix_fmt", "yuv420p", "-profile:v", "main", "-level:v", "4.1", "-ac", "2",
+			"-map_chapters", "0", "-movflags", "faststart", "-ac", "6", "out.mp4",
+		}},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		tt.opts(&opts)
+		if err := opts.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := ffmpegArgs(opts.withCompat(), nil, "in.mkv", "out.mp4"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ffmpegArgs =\n%q, want\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScaleLimit(t *testing.T) {
+	tests := []struct {
+		compat    string
+		maxHeight int
+		want      int
+	}{
+		{"", 0, 0},
+		{"", 720, 720},
+		{"dlna", 0, 1080},
+		{"dlna", 720, 720},
+		{"mobile", 720, 480},
+		{"mobile", 2160, 480},
+	}
+	for _, tt := range tests {
+		o := options{Compat: tt.compat, maxHeight: tt.maxHeight}
+		if got := o.scaleLimit(); got != tt.want {
+			t.Errorf("scaleLimit with -compat %q and height %d = %d, want %d", tt.compat, tt.maxHeight, got, tt.want)
+		}
+	}
+}
+
+func TestWithCompat(t *testing.T) {
+	tests := []struct {
+		compat, codec, acodec string
+		wantCodec, wantAcodec string
+	}{
+		{"", "copy", "", "copy", ""},
+		{"appletv", "copy", "", "libx264", "aac"},
+		{"appletv", "h264_nvenc", "libfdk_aac", "h264_nvenc", "libfdk_aac"},
+	}
+	for _, tt := range tests {
+		o := options{Compat: tt.compat, VideoCodec: tt.codec, AudioCodec: tt.acodec}.withCompat()
+		if o.VideoCodec != tt.wantCodec || o.AudioCodec != tt.wantAcodec {
+			t.Errorf("withCompat(%q, %q, %q) codecs = %q, %q, want %q, %q",
+				tt.compat, tt.codec, tt.acodec, o.VideoCodec, o.AudioCodec, tt.wantCodec, tt.wantAcodec)
+		}
+	}
+}
+
+func TestValidateCompat(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(*options)
+		ok   bool
+	}{
+		{"preset", func(o *options) { o.Compat = "ps3" }, true},
+		{"m4v", func(o *options) { o.Compat, o.OutExt = "ps3", ".m4v" }, true},
+		{"unknown", func(o *options) { o.Compat = "wii" }, false},
+		{"mkv output", func(o *options) { o.Compat, o.OutExt = "ps3", ".mkv" }, false},
+		{"audio only", func(o *options) { o.Compat, o.AudioOnly = "ps3", true }, false},
+		{"preserve all", func(o *options) { o.Compat, o.PreserveAll = "ps3", true }, false},
+		{"fragmented", func(o *options) { o.Compat, o.Fragmented = "ps3", true }, false},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		tt.opts(&opts)
+		if err := opts.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestWriteCompatPresets(t *testing.T) {
+	var b bytes.Buffer
+	writeCompatPresets(&b)
+	out := b.String()
+	for _, name := range compatNames() {
+		if !strings.Contains(out, name+" ") {
+			t.Errorf("-compat list doesn't list %s:\n%s", name, out)
+		}
+	}
+	want := `-c:v libx264 -c:a aac -pix_fmt yuv420p -profile:v baseline -level:v 3.0 -ac 2 -vf 'scale=-2:min(480\,ih)' -movflags faststart`
+	if !strings.Contains(out, want) {
+		t.Errorf("-compat list doesn't have the mobile arguments %s:\n%s", want, out)
+	}
+}
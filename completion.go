@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dirFlags are the flags completed with directories instead of files.
+var dirFlags = map[string]bool{"d": true, "temp-dir": true, "work-dir": true}
+
+// completionFlag is a flag as the completion scripts need it.
+type completionFlag struct {
+	name  string
+	usage string
+	arg   bool // whether it takes a value
+	dir   bool // whether its value is a directory
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		_, usage := flag.UnquoteUsage(f)
+		flags = append(flags, completionFlag{
+			name:  f.Name,
+			usage: strings.Join(strings.Fields(usage), " "),
+			arg:   !ok || !b.IsBoolFlag(),
+			dir:   dirFlags[f.Name],
+		})
+	})
+	return flags
+}
+
+// writeCompletion writes a script completing the flags of fs for shell,
+// which is bash, zsh or fish.
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	flags := completionFlags(fs)
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, flags)
+	case "zsh":
+		writeZshCompletion(w, flags)
+	case "fish":
+		writeFishCompletion(w, flags)
+	default:
+		return fmt.Errorf("unknown -completion %q (expected bash, zsh or fish)", shell)
+	}
+	return nil
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	var names, files, dirs []string
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+		switch {
+		case f.dir:
+			dirs = append(dirs, "-"+f.name)
+		case f.arg:
+			files = append(files, "-"+f.name)
+		}
+	}
+	fmt.Fprintf(w, `# bash completion for mkv2mp4, load with: source <(mkv2mp4 -completion bash)
+_mkv2mp4() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	case $prev in
+	%s)
+		COMPREPLY=($(compgen -d -- "$cur"))
+		return
+		;;
+	%s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F _mkv2mp4 mkv2mp4
+`, strings.Join(dirs, "|"), strings.Join(files, "|"), strings.Join(names, " "))
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "#compdef mkv2mp4")
+	fmt.Fprintln(w, "# zsh completion for mkv2mp4, load with: source <(mkv2mp4 -completion zsh)")
+	fmt.Fprintln(w, "_mkv2mp4() {")
+	fmt.Fprintln(w, "\t_arguments \\")
+	esc := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, esc.Replace(f.usage))
+		switch {
+		case f.dir:
+			spec += ":directory:_files -/"
+		case f.arg:
+			spec += ":value:_files"
+		}
+		fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintln(w, "\t\t'*:file:_files'")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _mkv2mp4 mkv2mp4")
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "# fish completion for mkv2mp4, load with: mkv2mp4 -completion fish | source")
+	esc := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	for _, f := range flags {
+		args := ""
+		switch {
+		case f.dir:
+			args = " -x -a '(__fish_complete_directories)'"
+		case f.arg:
+			args = " -r -F"
+		}
+		fmt.Fprintf(w, "complete -c mkv2mp4 -o %s%s -d '%s'\n", f.name, args, esc.Replace(f.usage))
+	}
+}
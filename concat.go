@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// concatJob merges sources, in order, into output with ffmpeg's concat
+// demuxer.
+type concatJob struct {
+	sources    []string
+	output     string
+	opts       options
+	onExisting string
+	dryRun     bool
+	deletes    *deleteCap
+	confirm    *confirmer
+	links      *linkTracker
+	logger     *log.Logger
+	errLogger  *log.Logger
+}
+
+// run merges the sources, removing them once the output verifies unless
+// the options keep them. The removals go through -confirm, -max-deletes and
+// -hardlink-policy like a conversion's, and sources that -hardlink-policy
+// skips are left out of the merge.
+func (c *concatJob) run(ctx context.Context) error {
+	c.checkLinks()
+	if len(c.sources) < 2 {
+		return fmt.Errorf("-concat needs at least two sources, found %d", len(c.sources))
+	} else if _, err := os.Stat(c.output); err == nil {
+		switch c.onExisting {
+		case existingSkip:
+			c.errLogger.Printf("Skipping the merge: %v: %s", ErrOutputExists, c.output)
+			return nil
+		case existingRename:
+			renamed, err := renamedOutput(c.output, false)
+			if err != nil {
+				return err
+			}
+			c.logger.Printf("%s exists, writing %s instead\n", c.output, renamed)
+			c.output = renamed
+		case existingOverwrite:
+			if !c.dryRun {
+				c.logger.Printf("Replacing %s\n", c.output)
+				if err := os.Remove(c.output); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("%w: %s", ErrOutputExists, c.output)
+		}
+	}
+	c.checkStreams()
+
+	list, err := writeConcatList(c.sources)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+
+	opts := c.opts.withCompat()
+	opts.concat = true
+	args := ffmpegArgs(opts, nil, list, c.output)
+	if c.dryRun {
+		fmt.Printf("%s -> %s: %s\n", strings.Join(c.sources, " + "), c.output, shellJoin(ffmpegCommandLine(args)))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.output), 0755); err != nil {
+		return err
+	}
+	c.logger.Printf("Merging %d files into %s\n", len(c.sources), c.output)
+	if err := runFFmpeg(ctx, args, nil, c.output, opts); err != nil {
+		return err
+	}
+	if _, err := verifyFile(c.output); err != nil {
+		return fmt.Errorf("verifying output: %v", err)
+	}
+
+	if opts.AudioOnly || opts.Keep {
+		return nil
+	}
+	removals := &removalQueue{sources: c.sources}
+	if n := removals.removeAll(c.confirm, c.deletes, c.links, c.logger, c.errLogger); n > 0 {
+		return fmt.Errorf("couldn't remove %d of the sources", n)
+	}
+	return nil
+}
+
+// checkLinks drops the sources -hardlink-policy skips, such as a second
+// name of a file already among them.
+func (c *concatJob) checkLinks() {
+	if c.links == nil {
+		return
+	}
+	sources := c.sources[:0]
+	for _, source := range c.sources {
+		if err := c.links.check(source); err != nil {
+			c.errLogger.Printf("Leaving %s out of the merge: %v", source, err)
+			continue
+		}
+		sources = append(sources, source)
+	}
+	c.sources = sources
+}
+
+// checkStreams warns about sources whose streams differ from the first
+// source's, which the concat demuxer can't join cleanly.
+func (c *concatJob) checkStreams() {
+	first, err := probe(c.sources[0])
+	if err != nil {
+		c.errLogger.Printf("Warning: couldn't check the streams of %s: %v", c.sources[0], err)
+		return
+	}
+	for _, source := range c.sources[1:] {
+		p, err := probe(source)
+		if err != nil {
+			c.errLogger.Printf("Warning: couldn't check the streams of %s: %v", source, err)
+		} else if diff := streamsDiffer(first, p); diff != "" {
+			c.errLogger.Printf("Warning: %s can't be cleanly joined to %s: %s", source, c.sources[0], diff)
+		}
+	}
+}
+
+// streamsDiffer describes the first difference between the streams of a
+// and b that matters to the concat demuxer, or returns "" if there's none.
+func streamsDiffer(a, b *probeResult) string {
+	if len(a.Streams) != len(b.Streams) {
+		return fmt.Sprintf("%d streams instead of %d", len(b.Streams), len(a.Streams))
+	}
+	for i, s := range a.Streams {
+		t := b.Streams[i]
+		switch {
+		case s.CodecType != t.CodecType:
+			return fmt.Sprintf("stream %d is %s instead of %s", i, t.CodecType, s.CodecType)
+		case s.CodecName != t.CodecName:
+			return fmt.Sprintf("stream %d is %s instead of %s", i, t.CodecName, s.CodecName)
+		case s.Width != t.Width || s.Height != t.Height:
+			return fmt.Sprintf("stream %d is %dx%d instead of %dx%d", i, t.Width, t.Height, s.Width, s.Height)
+		}
+	}
+	return ""
+}
+
+// writeConcatList writes the concat demuxer's list of sources to a
+// temporary file, returning its name.
+func writeConcatList(sources []string) (string, error) {
+	f, err := ioutil.TempFile("", "mkv2mp4-concat-*.txt")
+	if err != nil {
+		return "", err
+	}
+	for _, source := range sources {
+		abs, err := filepath.Abs(source)
+		if err == nil {
+			// the list quotes like a shell, so ' has to end the quote
+			_, err = fmt.Fprintf(f, "file '%s'\n", strings.Replace(abs, "'", `'\''`, -1))
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// concatOutput returns the default output of merging sources: the part of
+// their names they share, e.g. ep.mp4 for ep.part1.mkv and ep.part2.mkv,
+// or the name of their directory if they share none.
+func concatOutput(sources []string, ext string) string {
+	prefix := filepath.Base(sources[0])
+	for _, s := range sources[1:] {
+		name := filepath.Base(s)
+		i := 0
+		for i < len(prefix) && i < len(name) && prefix[i] == name[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	prefix = strings.TrimRight(prefix, "0123456789")
+	prefix = strings.TrimRight(prefix, " ._-")
+	for _, marker := range []string{".part", " part", "_part", "-part", ".cd", " cd", "_cd", "-cd"} {
+		if strings.HasSuffix(strings.ToLower(prefix), marker) {
+			prefix = prefix[:len(prefix)-len(marker)]
+			break
+		}
+	}
+	dir := filepath.Dir(sources[0])
+	if prefix = strings.TrimRight(prefix, " ._-"); prefix == "" {
+		abs, _ := filepath.Abs(dir)
+		prefix = filepath.Base(abs)
+	}
+	return filepath.Join(dir, prefix+ext)
+}
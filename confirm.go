@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// confirmer asks on the terminal before each source is removed.
+type confirmer struct {
+	mu     sync.Mutex
+	in     *bufio.Reader
+	out    io.Writer
+	yesAll bool
+}
+
+func newConfirmer(in io.Reader, out io.Writer) *confirmer {
+	return &confirmer{in: bufio.NewReader(in), out: out}
+}
+
+// ask reports whether filename may be removed. Anything but yes, including
+// the end of the input, keeps it.
+func (c *confirmer) ask(filename string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.yesAll {
+		fmt.Fprintf(c.out, "Remove %s? [y]es, [n]o, [a]ll: ", filename)
+		line, err := c.in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true
+		case "a", "all":
+			c.yesAll = true
+		case "n", "no":
+			return false
+		default:
+			if err != nil {
+				fmt.Fprintln(c.out)
+				return false
+			}
+		}
+	}
+	return true
+}
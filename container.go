@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// How -by-container converts the sources of a container.
+const (
+	containerCopy      = "copy"      // copy every stream (the usual default)
+	containerProbe     = "probe"     // copy what MP4 holds, transcode the rest, per the built-in -rules
+	containerTranscode = "transcode" // transcode the video and audio
+)
+
+// defaultContainerModes are the -by-container modes by source extension.
+// Sources with other extensions are converted as without -by-container.
+var defaultContainerModes = containerModes{
+	".mkv":  containerProbe,
+	".webm": containerProbe,
+	".ts":   containerProbe,
+	".m2ts": containerProbe,
+	".mp4":  containerCopy,
+	".m4v":  containerCopy,
+	".mov":  containerCopy,
+	".avi":  containerTranscode,
+	".wmv":  containerTranscode,
+	".asf":  containerTranscode,
+	".flv":  containerTranscode,
+	".mpg":  containerTranscode,
+	".mpeg": containerTranscode,
+	".vob":  containerTranscode,
+	".rmvb": containerTranscode,
+}
+
+// containerModes is a repeatable flag of ext=mode overrides of the
+// -by-container modes, e.g. avi=probe.
+type containerModes map[string]string
+
+func (m *containerModes) String() string {
+	if m == nil {
+		return ""
+	}
+	var s []string
+	for ext, mode := range *m {
+		s = append(s, strings.TrimPrefix(ext, ".")+"="+mode)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (m *containerModes) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("expected ext=mode, got %q", v)
+	}
+	ext, mode := "."+strings.TrimPrefix(strings.ToLower(v[:i]), "."), v[i+1:]
+	if mode != containerCopy && mode != containerProbe && mode != containerTranscode {
+		return fmt.Errorf("unknown mode %q (expected copy, probe or transcode)", mode)
+	}
+	if *m == nil {
+		*m = make(containerModes)
+	}
+	(*m)[ext] = mode
+	return nil
+}
+
+// withDefaults returns the default modes with m's overrides applied.
+func (m containerModes) withDefaults() containerModes {
+	all := make(containerModes, len(defaultContainerModes)+len(m))
+	for ext, mode := range defaultContainerModes {
+		all[ext] = mode
+	}
+	for ext, mode := range m {
+		all[ext] = mode
+	}
+	return all
+}
+
+// apply returns opts set up to convert filename per the mode of its
+// container. Options that already choose how streams are converted, such as
+// -codec or -rules, win over the mode.
+func (m containerModes) apply(filename string, opts options) (options, string) {
+	if !opts.videoCopied() || opts.AudioCodec != "" || opts.Rules != nil ||
+		opts.AudioOnly || opts.TranscodeMissing || opts.PreserveAll {
+		return opts, ""
+	}
+	mode := m[strings.ToLower(filepath.Ext(filename))]
+	switch mode {
+	case containerProbe:
+		opts.Rules = ruleSet{}
+	case containerTranscode:
+		opts.VideoCodec = transcodeCodecs["video"]
+		opts.AudioCodec = transcodeCodecs["audio"]
+	}
+	return opts, mode
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// partialHashSize is how much of each end of a file is hashed for the quick
+// duplicate check.
+const partialHashSize = 1 << 20
+
+// deduper detects source files with identical content. Files are first
+// compared by size and a hash of their first and last megabyte, and only
+// files matching on those are hashed in full. It's safe for concurrent use.
+type deduper struct {
+	mu   sync.Mutex
+	seen map[string][]string
+	full map[string]string
+}
+
+func newDeduper() *deduper {
+	return &deduper{seen: make(map[string][]string), full: make(map[string]string)}
+}
+
+// duplicateOf returns an earlier file with the same content as path, or ""
+// if path is the first of its kind, in which case it's recorded.
+func (d *deduper) duplicateOf(path string, size int64) (string, error) {
+	key, err := partialHash(path, size)
+	if err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, candidate := range d.seen[key] {
+		a, err := d.fullHash(candidate)
+		if err != nil {
+			return "", err
+		}
+		b, err := d.fullHash(path)
+		if err != nil {
+			return "", err
+		}
+		if a == b {
+			return candidate, nil
+		}
+	}
+	d.seen[key] = append(d.seen[key], path)
+	return "", nil
+}
+
+// fullHash must be called with d.mu held.
+func (d *deduper) fullHash(path string) (string, error) {
+	if h, ok := d.full[path]; ok {
+		return h, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	d.full[path] = sum
+	return sum, nil
+}
+
+func partialHash(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.CopyN(h, f, partialHashSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	if size > 2*partialHashSize {
+		if _, err = f.Seek(-partialHashSize, io.SeekEnd); err != nil {
+			return "", err
+		}
+		if _, err = io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d:%x", size, h.Sum(nil)), nil
+}
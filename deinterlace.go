@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idetRE matches the totals idet logs once it's done. The multi frame
+// detection is used since it's less fooled by single noisy frames.
+var idetRE = regexp.MustCompile(`Multi frame detection: TFF:\s*(\d+)\s+BFF:\s*(\d+)\s+Progressive:\s*(\d+)`)
+
+// parseIdet reports whether the idet statistics in ffmpeg's output out
+// find most frames interlaced. ok is false if out has no statistics.
+func parseIdet(out []byte) (interlaced, ok bool) {
+	m := idetRE.FindSubmatch(out)
+	if m == nil {
+		return false, false
+	}
+	tff, _ := strconv.Atoi(string(m[1]))
+	bff, _ := strconv.Atoi(string(m[2]))
+	progressive, _ := strconv.Atoi(string(m[3]))
+	return tff+bff > progressive, true
+}
+
+// idetCache holds the results of interlace detection, keyed like the probe
+// cache so a changed file is detected again. It's safe for concurrent use.
+type idetCache struct {
+	mu      sync.Mutex
+	results map[probeKey]bool
+}
+
+var idets = &idetCache{results: make(map[probeKey]bool)}
+
+// isInterlaced runs ffmpeg's idet filter over the first sample of
+// filename's video, reporting whether it's interlaced.
+func (w *worker) isInterlaced(filename string, sample time.Duration) (bool, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	k := probeKey{path: filename, size: info.Size(), modTime: info.ModTime()}
+	idets.mu.Lock()
+	interlaced, ok := idets.results[k]
+	idets.mu.Unlock()
+	if ok {
+		return interlaced, nil
+	}
+
+	// idet only logs its statistics at the info level, once it's done
+	stderr := &tailBuffer{max: stderrTail}
+	args := []string{"-hide_banner", "-nostats", "-loglevel", "info"}
+	if sample > 0 {
+		args = append(args, "-t", strconv.FormatFloat(sample.Seconds(), 'f', -1, 64))
+	}
+	args = append(args, "-i", filename, "-map", "0:v:0", "-vf", "idet", "-an", "-sn", "-f", "null", "-")
+	cmd := ffmpegCommand(w.deadline, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return false, ffmpegError(w.deadline, err, stderr)
+	}
+	interlaced, ok = parseIdet(stderr.buf)
+	if !ok {
+		return false, fmt.Errorf("no idet statistics in ffmpeg's output")
+	}
+
+	idets.mu.Lock()
+	idets.results[k] = interlaced
+	idets.mu.Unlock()
+	return interlaced, nil
+}
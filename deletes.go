@@ -0,0 +1,24 @@
+package main
+
+import "sync/atomic"
+
+// deleteCap limits how many sources a run removes, as a guard against a
+// mistyped -d. It's safe for concurrent use, and a nil cap has no limit.
+type deleteCap struct {
+	max int64
+	n   int64 // removals asked for so far, including refused ones
+}
+
+// take reserves n removals, reporting false if they'd exceed the cap, in
+// which case nothing may be removed.
+func (c *deleteCap) take(n int) bool {
+	if c == nil {
+		return true
+	}
+	return atomic.AddInt64(&c.n, int64(n)) <= c.max
+}
+
+// hit reports whether a removal was refused.
+func (c *deleteCap) hit() bool {
+	return c != nil && atomic.LoadInt64(&c.n) > c.max
+}
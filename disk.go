@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// diskLimiter limits how many conversions read from the same device at once.
+type diskLimiter struct {
+	mu    sync.Mutex
+	n     int
+	slots map[uint64]chan struct{}
+}
+
+func newDiskLimiter(n int) *diskLimiter {
+	return &diskLimiter{n: n, slots: make(map[uint64]chan struct{})}
+}
+
+// acquire blocks until a slot is free on the device holding the file
+// described by info, returning a func releasing it, or ErrTimeout if ctx is
+// done first. It doesn't block when the device can't be determined.
+func (l *diskLimiter) acquire(ctx context.Context, info os.FileInfo) (func(), error) {
+	dev, ok := deviceID(info)
+	if !ok {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	slots, ok := l.slots[dev]
+	if !ok {
+		slots = make(chan struct{}, l.n)
+		l.slots[dev] = slots
+	}
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+}
+
+// fsFree is the space left on a file system for unprivileged users.
+type fsFree struct {
+	bytes       uint64
+	inodes      uint64
+	inodesKnown bool // false where the file system doesn't limit them
+}
+
+// checkFree returns an error if the file system holding dir has less than
+// minBytes or minInodes free. It does nothing where the free space can't be
+// read.
+func checkFree(dir string, minBytes int64, minInodes uint64) error {
+	free, ok, err := statFree(dir)
+	if err != nil || !ok {
+		return nil
+	}
+	if free.bytes < uint64(minBytes) {
+		return fmt.Errorf("%w: %s free in %s, less than -min-free %s", ErrDiskFull, formatSize(int64(free.bytes)), dir, formatSize(minBytes))
+	}
+	if free.inodesKnown && free.inodes < minInodes {
+		return fmt.Errorf("%w: %d free in %s, less than -min-free-inodes %d", ErrNoInodes, free.inodes, dir, minInodes)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// deviceID isn't supported on this platform.
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileLinks isn't supported on this platform.
+func fileLinks(info os.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}
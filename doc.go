@@ -0,0 +1,426 @@
+/*
+Command mkv2mp4 converts MKV files to MP4 with ffmpeg, removing each source
+once its conversion succeeds.
+
+	mkv2mp4 -d ~/videos -r -c 2 -v
+	mkv2mp4 -f movie.mkv
+
+# Environment
+
+Every flag not given on the command line is read from an environment
+variable when it's set, so a flag takes precedence over the environment,
+which takes precedence over the default. The variable is named MKV2MP4_
+followed by the flag's name in upper case with dashes replaced by
+underscores, such as MKV2MP4_CODEC for -codec or MKV2MP4_OUT_EXT for
+-out-ext. The single letter flags use longer names:
+
+	-c  MKV2MP4_WORKERS
+	-d  MKV2MP4_DIR
+	-f  MKV2MP4_FILE
+	-l  MKV2MP4_LOG_FILE
+	-r  MKV2MP4_RECURSE
+	-v  MKV2MP4_VERBOSE
+
+Boolean variables take the same values as their flags, e.g. true or 0.
+-version and -completion are only read from the command line.
+
+# Syslog
+
+With -syslog everything logged also goes to the local syslog daemon, or the
+server given by -syslog-addr, under the tag mkv2mp4 and the daemon facility.
+Like the -l file it gets the messages -v prints, at info, while errors are
+sent at err, warnings at warning and skipped files at notice. Errors are
+still printed to stderr, and the rest only with -v. syslog isn't available
+on Windows, where -syslog fails.
+
+# Shell completion
+
+-completion prints a script completing mkv2mp4's flags for bash, zsh or
+fish, made from the flags of the running binary so it's never out of date:
+
+	source <(mkv2mp4 -completion bash)
+	mkv2mp4 -completion fish | source
+
+Flag values are completed as file names, or directories for -d and
+-temp-dir.
+
+# A/V sync
+
+Some MKVs come out of a copy with the audio out of sync, most often because
+their audio starts at a negative timestamp, which MP4 players handle
+differently from MKV ones. -fix-sync applies a comma separated list of
+fixes while converting:
+
+	zero-ts         shift all timestamps so none are negative (works with copy)
+	resample-audio  stretch or pad the audio to match its timestamps (needs -acodec)
+	cfr             duplicate or drop frames for a constant frame rate (needs -codec)
+
+Try zero-ts first, since it doesn't need re-encoding.
+
+-copyts does the opposite, keeping the source's timestamps exactly, which
+matters when outputs are later joined or synced against external data.
+Since the fixes all change timestamps it can't be combined with -fix-sync.
+-start-at-zero still shifts the timestamps to start at zero, but keeps the
+gaps between them.
+
+# Estimates
+
+-dry-run ends with an estimate of how long the run would take and how much
+space its outputs would use. It's a rough projection, not a measurement:
+re-encodes are assumed to run at -estimate-speed times real time and to
+shrink to -estimate-ratio of their source, while copies are assumed to
+write an output the size of their source at 100M/s. Convert a few files
+first and set both from how they went for a better estimate.
+
+# Per-container defaults
+
+With -by-container, how a source is converted depends on its container, so
+a mix of MKVs and older formats can be handled in a single run (add their
+extensions to -ext):
+
+	probe      .mkv .webm .ts .m2ts
+	copy       .mp4 .m4v .mov
+	transcode  .avi .wmv .asf .flv .mpg .mpeg .vob .rmvb
+
+probe copies the streams MP4 can hold and transcodes the rest, following the
+built-in rules of -rules. transcode converts the video to H.264 and the
+audio to AAC, and copy copies every stream as without -by-container.
+-container-mode changes the mode of an extension, e.g. -container-mode
+avi=probe. Sources whose options already pick their codecs, with -codec,
+-acodec, -rules or a per-file options file, keep them.
+
+# Per-file options
+
+A file next to a source named after it with .json appended, such as
+movie.mkv.json, overrides the conversion options for that source only. It
+holds an object with the same names as the options of POST /convert, and
+like those can't set input_args, ffmpeg_args or lut (see Server mode):
+
+	{"acodec": "aac", "ab": "192k"}
+
+# Required streams
+
+Some files named .mkv hold only audio, or only data, and copying one into an
+MP4 and removing it is rarely what was meant. Each source is probed with
+ffprobe before it's converted, and one without a video stream, other than
+cover art, is skipped and kept. -require-audio does the same for sources
+without audio. Skipped sources are counted as missing-stream in the summary,
+-report and -summary-json apart from other skips, with the stream missing
+as the reason. -require-video=false converts them anyway, and it doesn't
+apply with -audio-only.
+
+# Resolution
+
+-only-resolution only converts sources whose video height matches, such as
+-only-resolution >=2160 to re-encode 4K files and leave the rest alone. It
+takes a height, with or without a p (1080p), or 4k, uhd or 8k, optionally
+after >=, <= or ==, which is the default. Video cropped wider than 16:9 is
+matched by its width, so a 1920x800 film counts as 1080p, and portrait video
+by its shorter side. It's checked after the other filters, such as -min-size
+and -older-than, since it runs ffprobe on each source; the result is kept
+for the conversion, so sources aren't probed twice. Sources without video,
+or that ffprobe can't read, are skipped, and with -v each skipped source is
+logged with the resolution found.
+
+# Conversion order
+
+Sources are found in the order set by -order, and by default converted in
+the order they were found. -priority picks the next source to convert by
+another key whenever a worker is free, so in server mode new submissions can
+jump ahead of a backlog:
+
+	fifo  in the order they were queued (the default)
+	size  smallest first
+	age   most recently modified first
+	tag   highest "priority" first, as given to POST /convert
+
+Sources with the same priority keep the order they were queued in, so every
+source queued by -d has the same tag priority, 0. Sizes and times are read
+when a source is queued.
+
+# Hard links
+
+A source with more than one hard link is one file under several names, so
+converting each name would convert the same content again, and removing one
+leaves the others behind. -hardlink-policy decides what's done with them:
+
+	skip          leave them alone
+	convert-once  convert the first name reached and skip the others (the default)
+	delete-all    like convert-once, but once it's converted remove every name found
+
+A file only records how many links it has, not where they are, so
+delete-all searches -d (or the source's directory without it) for the other
+names and warns about those it can't find, which are left in place. Links
+aren't detected on Windows, where every name is converted.
+
+# Limiting removals
+
+-max-deletes stops a run once it has removed that many sources, keeping the
+rest along with the outputs already written, and reports that the limit was
+reached. It's unlimited by default, but worth setting for unattended runs,
+such as from cron, so that a mistyped -d can't empty a whole library.
+
+# Checksums
+
+-manifest takes a list of the sources' SHA-256 digests in the format written
+by sha256sum, with relative paths relative to the list's directory:
+
+	e3b0c442...b855  movies/movie.mkv
+
+Each source is checked against it before it's converted, and one that isn't
+listed or doesn't match is left alone and counted as failed, since it may be
+corrupt. -manifest-out appends the digests of the outputs in the same
+format, so they can be checked later with sha256sum -c.
+
+# Existing outputs
+
+-on-existing decides what's done when a source's output is already there,
+such as a show.mp4 next to show.mkv:
+
+	error      fail the source, keeping it (the default)
+	skip       leave the source and output alone, counting it as skipped
+	overwrite  convert the source again, replacing the output
+	rename     write the output under the first free name of "show (2).mp4",
+	           "show (3).mp4", ...
+
+With -incremental an output newer than its source is always skipped, and
+-on-existing only decides what's done with older ones, replacing them by
+default. Renamed segments are numbered before their segment number, as in
+show (2)_000.mp4, and a renamed -split-chapters or -rendition output only
+takes the numbered name for that part.
+
+# Temporary outputs
+
+Each output is written under a temporary name, its final name followed by
+-temp-suffix (.partial by default), and renamed once it's converted, so an
+interrupted run never leaves a partial file under the final name. With
+-temp-dir the temporary file is written in that directory instead, such as
+on a fast local disk when the outputs go to a slow network share. When the
+directory is on another file system than the output, renaming isn't
+possible, so the file is copied next to the output, keeping its
+permissions, and renamed from there, then removed. Renames failing for any
+other reason, such as a missing directory, fail the conversion.
+
+-faststart rewrites the whole output once it's written to move its index to
+the start, reading and writing it a second time. With -faststart-local only
+those outputs go to -temp-dir, or to the system's temporary directory
+without it, so that pass runs on the local disk and a slow destination such
+as an NFS share sees the finished file written once.
+
+# Free space
+
+-min-free and -min-free-inodes keep a conversion from starting when the
+disk its output is written to, and its temporary output with -temp-dir, has
+less space or fewer inodes free, failing it with disk-full or no-inodes
+instead. A disk can run out of inodes with plenty of space left, such as one
+holding millions of small files, and writes then fail with the same "no
+space left on device". File systems that don't limit their inodes, such as
+btrfs, skip that check, and both are skipped on Windows and other systems
+where the free space can't be read.
+
+# Read rate
+
+-read-rate limits how fast each source is read, for sources on a network
+share that converting would otherwise saturate. ffmpeg is given the source
+as piped input instead of its path, so it can't seek in it. Most MKVs
+convert fine that way, but demuxers that need to seek, such as MP4 inputs
+with their index at the end, may fail or lose streams. The reads of ffprobe
+and -validate-input aren't limited.
+
+# CPU affinity
+
+With -affinity the ffmpeg processes of each worker are pinned to their own
+range of CPUs, so concurrent encodes don't contend for the same cores and
+caches. The CPUs are split evenly between the -c workers in order: with 16
+CPUs and 4 workers, worker 1 gets CPUs 0-3, worker 2 gets 4-7 and so on.
+CPUs left over from an uneven split go unused, and with more workers than
+CPUs, workers share them. It's only supported on Linux and ignored with a
+warning elsewhere.
+
+# Automatic concurrency
+
+-auto-concurrency finds how many conversions to run at once instead of -c:
+it starts with one, and after each -auto-concurrency-interval (2 minutes by
+default) compares how many bytes of sources were converted per second with
+the interval before. While that rises by more than 5% another conversion is
+added, and once it doesn't the last one added is taken away again and the
+number stays there for the rest of the run. Each change and the number
+settled on are logged, and -c caps it, or the number of CPUs with -c 1.
+
+Only finished conversions count, and an interval lasts until each
+conversion running has finished at least one file, so with long sources
+set the interval to a few times how long one takes. Sources copied rather
+than re-encoded are mostly limited by the disks, where more conversions
+rarely help. Workers held back finish their conversion first, and with
+-affinity the CPUs are split for the largest number.
+
+# System load
+
+With -max-load no new conversion starts while the system's 1 minute load
+average is at or above the given value, so conversions back off on a busy
+shared machine. The load is read again every 5 seconds until it drops
+below, and conversions already running are left to finish. The load
+average lags behind the work started, so several workers freed at once can
+all start before it rises. It's read from /proc/loadavg, so -max-load is
+only supported on Linux and ignored with a warning elsewhere.
+
+# Target size
+
+-target-size re-encodes the video at the bitrate that fits each output in
+the given size, such as for attachments or old devices with a file size
+limit:
+
+	mkv2mp4 -f movie.mkv -target-size 700M -acodec aac -ab 128k
+
+The bitrate is worked out from the source's duration, less the bitrate of
+its audio (-ab, the copied streams' own or 128k) and 2% for the container.
+With libx264, libvpx, libvpx-vp9 and libaom-av1 the video is encoded in two
+passes, which lands much closer to the target than a single one. It's kept
+between 100kb/s and 100Mb/s; a target too small for even 100kb/s gets a
+warning and an output larger than asked for.
+
+# Renditions
+
+Each -rendition gives a source its own output, with the video scaled to the
+rendition's height and its name before the extension, instead of the usual
+single output:
+
+	mkv2mp4 -d ~/videos -rendition 1080p:crf23 -rendition 720p:crf25
+
+writes movie_1080p.mp4 and movie_720p.mp4 for movie.mkv. The renditions are
+converted one after another, the video re-encoded with -codec or libx264,
+and the source is only removed once all of them are done. When one fails
+the renditions already written are removed too, so a retry starts over.
+
+# Chapters
+
+With -split-chapters each chapter of a source is converted into its own
+output, named after the source and the chapter's title:
+
+	movie - Opening.mp4
+	movie - Chapter 02.mp4
+
+Characters file systems reserve, such as / and :, are replaced with _ in
+titles, untitled chapters are numbered, and repeated titles get (2), (3),
+... appended. The outputs don't carry the source's chapters. As with
+renditions, the source is only removed once every chapter is converted,
+and a source without chapters is converted whole, with a warning. When the
+video is copied each chapter starts at the keyframe before its start, so
+neighbouring outputs can overlap slightly; re-encode with -codec for exact
+cuts.
+
+# Segments
+
+-segment splits each output into files of about the given length, named
+after the output with a three digit number appended (movie_000.mp4,
+movie_001.mp4, ...). The source is only removed once every segment is
+written, and verified with -verify. Splits can only happen at keyframes when
+the video is copied, so segments are often longer than asked for; re-encode
+the video with -codec for more even lengths.
+
+# Resuming
+
+Converting a source into several files lets an interrupted run carry on
+where it stopped with -resume instead of starting over. With -segment the
+segments already written are checked with ffprobe in order, the first
+broken or missing one and everything after it are converted again, and so
+is the last good one, which may have been cut short; the conversion then
+seeks to where the kept segments end. With -split-chapters and -rendition
+each output left by an earlier run that ffprobe reads fine is kept, and a
+failed part no longer removes the outputs written before it. When the video
+is copied the seek lands on a keyframe, so a resumed segment may repeat a
+few frames of the one before it.
+
+A single output is written to a temporary file that's removed when its
+conversion stops, and ffmpeg can't append to an MP4 it didn't finish, so
+without one of those flags -resume does nothing and the source is converted
+from the start.
+
+# Proxies
+
+-proxy keeps a tree of masters intact and writes a smaller copy of each to
+the same place in another tree, such as for editing or streaming:
+
+	mkv2mp4 -d /masters -r -proxy /proxies
+
+converts /masters/show/ep1.mkv to /proxies/show/ep1.mp4. It's short for a
+set of other flags, each of which can still be changed:
+
+	-keep                    the masters are never removed
+	-map-output /masters=/proxies
+	-incremental             a master is only converted again once it's
+	                         newer than its proxy
+	-codec libx264           unless -codec is given
+	-proxy-crf 28            the video's quality, unless -target-size is given
+	-proxy-height 720        taller video is scaled down, keeping its ratio
+	-acodec aac -ab 128k     unless -acodec or -ab is given
+
+-map-output and -on-existing can be given alongside it, the closest mapping
+winning. It needs -d, and can't be used with -serve, -stdout, -audio-only or
+-concat.
+
+# Device presets
+
+Older hardware players, such as TVs and consoles, only play part of what MP4
+can hold. -compat re-encodes for one of them with a set of options known to
+work, so they don't have to be looked up:
+
+	mkv2mp4 -d ~/videos -compat dlna
+
+Each preset re-encodes the video with -codec or libx264 in 8-bit 4:2:0 at a
+profile and level the device decodes, scaled down when it's taller than the
+device plays, and the audio with -acodec or AAC in stereo, with the index at
+the start of the file. -compat list prints the presets and the arguments
+each adds. -ffmpeg-args come after them, so they can override any of them.
+
+# Fragmented output
+
+With -fragmented the output is written as fragmented MP4, split into
+self-contained fragments that DASH and HLS packagers can segment without
+remuxing. Some players and editors handle fragmented files poorly, seeking
+slowly or not at all, so only use it for files headed to a packager. The
+index of a fragmented file is already at its start, which is why -faststart
+can't be combined with it.
+
+# Sandboxing
+
+-exec-wrapper runs each ffmpeg inside another command, which is given
+ffmpeg and its arguments after its own:
+
+	mkv2mp4 -d ~/videos -exec-wrapper "firejail --quiet --net=none"
+
+The wrapper is split like a shell would, so quote arguments holding spaces.
+On Unix it runs in its own process group, which is killed as a whole when a
+conversion is stopped, taking ffmpeg and anything else the wrapper started
+with it. A container started by docker run isn't a child of the wrapper, so
+pass it --rm and --init, or it may outlive the conversion. ffprobe isn't
+wrapped.
+
+# Server mode
+
+With -serve, mkv2mp4 runs an HTTP API instead of exiting once its inputs are
+queued:
+
+	POST /convert    queue {"source": "/path/to/file.mkv", "options": {...}}
+	GET  /status     list every job and its state
+	GET  /jobs/{id}  show a single job
+	GET  /healthz    report that the server is up
+	GET  /readyz     report whether jobs can be converted (503 without ffmpeg)
+
+The source has to be a file under -serve-root, which defaults to -d, that a
+scan of it would pick up: it's checked with -ext, -exclude, -skip-hidden and
+the other filters, after resolving symlinks, and rejected with 403 when it's
+outside the root or 400 when it isn't selected. -serve needs one of the two.
+
+The options object uses the same names as the JSON tags of the conversion
+options (codec, acodec, ab, ...) and overrides the command line values for
+that job only. Since anyone reaching the server can set them, the options
+passing raw arguments to ffmpeg or naming files (input_args, ffmpeg_args
+and lut) can't be, and are only taken from the command line and -batch.
+
+Dispatch of queued jobs can be paused without stopping the server. Sending
+SIGUSR2 toggles the pause, and while the file named by -pause-file exists no
+new conversions start, including those queued by -d or -f. Conversions already running are left to finish. The
+signal isn't available on Windows, where only the pause file works.
+*/
+package main
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the name of the environment variable read for each flag.
+const envPrefix = "MKV2MP4_"
+
+// envNames are the variable names of flags too short to make a readable one.
+var envNames = map[string]string{
+	"c": "WORKERS",
+	"d": "DIR",
+	"f": "FILE",
+	"l": "LOG_FILE",
+	"r": "RECURSE",
+	"v": "VERBOSE",
+}
+
+// envSkipped are the flags never read from the environment, since they
+// replace the run with printing something and exiting.
+var envSkipped = map[string]bool{
+	"completion": true,
+	"version":    true,
+}
+
+// envName returns the environment variable read for the flag name, e.g.
+// MKV2MP4_OUT_EXT for -out-ext.
+func envName(name string) string {
+	if n, ok := envNames[name]; ok {
+		return envPrefix + n
+	}
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnv sets each flag of fs not given on the command line from its
+// environment variable, if that's set, other than those in envSkipped.
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || envSkipped[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, name, setErr)
+			}
+		}
+	})
+	return err
+}
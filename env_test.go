@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("mkv2mp4", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	codec := fs.String("codec", "copy", "")
+	ext := fs.String("out-ext", ".mp4", "")
+	workers := fs.Int("c", 1, "")
+	version := fs.Bool("version", false, "")
+	completion := fs.String("completion", "", "")
+	if err := fs.Parse([]string{"-codec", "libx265"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("MKV2MP4_CODEC", "libx264")
+	t.Setenv("MKV2MP4_OUT_EXT", ".m4v")
+	t.Setenv("MKV2MP4_WORKERS", "4")
+	t.Setenv("MKV2MP4_VERSION", "true")
+	t.Setenv("MKV2MP4_COMPLETION", "bash")
+	if err := applyEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *codec != "libx265" {
+		t.Errorf("-codec = %q, want the command line's libx265", *codec)
+	}
+	if *ext != ".m4v" {
+		t.Errorf("-out-ext = %q, want .m4v from the environment", *ext)
+	}
+	if *workers != 4 {
+		t.Errorf("-c = %d, want 4 from MKV2MP4_WORKERS", *workers)
+	}
+	if *version || *completion != "" {
+		t.Errorf("-version = %v, -completion = %q, want them left unset", *version, *completion)
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	fs := flag.NewFlagSet("mkv2mp4", flag.ContinueOnError)
+	fs.Int("c", 1, "")
+	t.Setenv("MKV2MP4_WORKERS", "many")
+	if err := applyEnv(fs); err == nil {
+		t.Error("applyEnv accepted MKV2MP4_WORKERS=many")
+	}
+}
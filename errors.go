@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// Errors a conversion can fail with, wrapped with the details of the
+// failure. They're exported for callers converting with this code to tell
+// failures apart with errors.Is.
+var (
+	ErrFFmpegNotFound    = errors.New("ffmpeg not found")
+	ErrKilled            = errors.New("ffmpeg killed")
+	ErrIncompatibleCodec = errors.New("codec not supported by the output container")
+	ErrOutputExists      = errors.New("output already exists")
+	ErrUpToDate          = errors.New("output is up to date")
+	ErrTimeout           = errors.New("stopped by -deadline")
+	ErrSourceCorrupt     = errors.New("source appears corrupt")
+	ErrUnreadable        = errors.New("cannot read source")
+	ErrChecksum          = errors.New("source doesn't match its -manifest checksum")
+	ErrHardlink          = errors.New("source is hard linked")
+	ErrDiskFull          = errors.New("no space left on device")
+	ErrNoInodes          = errors.New("too few free inodes on device")
+	ErrNetwork           = errors.New("network error")
+	ErrHook              = errors.New("post-hook failed")
+	ErrHWDevice          = errors.New("hardware device unavailable")
+	ErrSink              = errors.New("upload to -sink failed")
+	ErrNoVideo           = errors.New("source has no video stream")
+	ErrNoAudio           = errors.New("source has no audio stream")
+)
+
+// errorNames names the kinds of error for flags, in the order failures are
+// grouped by.
+var errorNames = []struct {
+	name string
+	kind error
+}{
+	{"ffmpeg-not-found", ErrFFmpegNotFound},
+	{"killed", ErrKilled},
+	{"incompatible-codec", ErrIncompatibleCodec},
+	{"output-exists", ErrOutputExists},
+	{"up-to-date", ErrUpToDate},
+	{"deadline", ErrTimeout},
+	{"source-corrupt", ErrSourceCorrupt},
+	{"unreadable", ErrUnreadable},
+	{"checksum", ErrChecksum},
+	{"hardlink", ErrHardlink},
+	{"disk-full", ErrDiskFull},
+	{"no-inodes", ErrNoInodes},
+	{"network", ErrNetwork},
+	{"post-hook", ErrHook},
+	{"hw-device", ErrHWDevice},
+	{"sink", ErrSink},
+	{"no-video", ErrNoVideo},
+	{"no-audio", ErrNoAudio},
+}
+
+// errorKind returns which of the kinds above err is, or nil if none.
+func errorKind(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return ErrDiskFull
+	}
+	for _, e := range errorNames {
+		if errors.Is(err, e.kind) {
+			return e.kind
+		}
+	}
+	return nil
+}
+
+// errorByName returns the kind of error called name.
+func errorByName(name string) (error, bool) {
+	for _, e := range errorNames {
+		if e.name == name {
+			return e.kind, true
+		}
+	}
+	return nil, false
+}
+
+// kindNames lists the names of the kinds of error.
+func kindNames() string {
+	names := make([]string, len(errorNames))
+	for i, e := range errorNames {
+		names[i] = e.name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// copyRate is the speed a remux is assumed to run at, since copying streams
+// is bound by the disks rather than the CPU.
+const copyRate = 100 << 20 // bytes per second
+
+// estimate projects how long the files planned by -dry-run would take to
+// convert and how much space their outputs would use. It's safe for
+// concurrent use.
+type estimate struct {
+	speed   float64 // media seconds re-encoded per second
+	ratio   float64 // output size of a re-encode relative to its source
+	workers int
+
+	mu       sync.Mutex
+	times    []time.Duration // the projected time of each file
+	media    float64         // total media seconds
+	bytesIn  int64
+	bytesOut int64
+	encodes  int
+	unknown  int // files whose duration couldn't be probed
+}
+
+// add records a file of size bytes and the given media duration in seconds,
+// 0 if unknown, that's re-encoded or copied.
+func (e *estimate) add(size int64, duration float64, encode bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bytesIn += size
+	e.media += duration
+	t := float64(size) / copyRate
+	out := size
+	if encode {
+		e.encodes++
+		t = duration / e.speed
+		out = int64(float64(size) * e.ratio)
+		if duration == 0 {
+			e.unknown++
+		}
+	}
+	e.bytesOut += out
+	e.times = append(e.times, time.Duration(t*float64(time.Second)))
+}
+
+// wall returns the projected time to convert every file with e.workers
+// converting at once. Each file goes to the first worker to become free, in
+// the order the files were planned. It must be called with e.mu held.
+func (e *estimate) wall() time.Duration {
+	busy := make([]time.Duration, e.workers)
+	for _, t := range e.times {
+		sort.Slice(busy, func(i, j int) bool { return busy[i] < busy[j] })
+		busy[0] += t
+	}
+	var max time.Duration
+	for _, b := range busy {
+		if b > max {
+			max = b
+		}
+	}
+	return max
+}
+
+func (e *estimate) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Estimate (approximate; re-encodes at %gx real time, copies at %s/s):\n", e.speed, formatSize(copyRate))
+	fmt.Fprintf(&b, "  files:       %d (%d re-encoded, %d copied)\n", len(e.times), e.encodes, len(e.times)-e.encodes)
+	fmt.Fprintf(&b, "  media:       %s\n", time.Duration(e.media*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(&b, "  time:        ~%s with %d workers\n", e.wall().Round(time.Second), e.workers)
+	fmt.Fprintf(&b, "  output size: ~%s from %s (re-encodes at %g of their source, copies the same size)", formatSize(e.bytesOut), formatSize(e.bytesIn), e.ratio)
+	if e.unknown > 0 {
+		fmt.Fprintf(&b, "\n  %d re-encoded files have an unknown duration and aren't counted in the time", e.unknown)
+	}
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What -on-existing does with an output that already exists.
+const (
+	existingError     = "error"     // fail the source
+	existingSkip      = "skip"      // leave the source and output alone
+	existingOverwrite = "overwrite" // convert again over the output
+	existingRename    = "rename"    // write the output under a free name
+)
+
+// maxRenames is how many numbered names -on-existing rename tries before
+// giving up on a source.
+const maxRenames = 1000
+
+// renamedOutput returns the first of name with " (2)", " (3)", ... inserted
+// before its extension that's free, e.g. "movie (2).mp4". With segmented a
+// segment pattern is numbered before its segment number, and a name is free
+// when its first segment is.
+func renamedOutput(name string, segmented bool) (string, error) {
+	tail := filepath.Ext(name)
+	if segmented {
+		tail = "_%03d" + tail
+	}
+	base := strings.TrimSuffix(name, tail)
+	for n := 2; n <= maxRenames; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, tail)
+		existing := candidate
+		if segmented {
+			existing = firstSegment(candidate)
+		}
+		if _, err := os.Lstat(existing); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s and %d numbered names after it", ErrOutputExists, name, maxRenames-1)
+}
+
+// keptOutput reports whether err means a source was left alone because its
+// output is already there, rather than a failure.
+func (w *worker) keptOutput(err error) bool {
+	return errors.Is(err, ErrUpToDate) || (w.onExisting == existingSkip && errors.Is(err, ErrOutputExists))
+}
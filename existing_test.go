@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenamedOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		segmented bool
+		existing  []string
+		want      string
+	}{
+		{"first free", "movie.mp4", false, []string{"movie.mp4"}, "movie (2).mp4"},
+		{"numbered taken", "movie.mp4", false, []string{"movie.mp4", "movie (2).mp4", "movie (3).mp4"}, "movie (4).mp4"},
+		{"gap reused", "movie.mp4", false, []string{"movie.mp4", "movie (3).mp4"}, "movie (2).mp4"},
+		{"dotted name", "show.s01e01.mp4", false, []string{"show.s01e01.mp4"}, "show.s01e01 (2).mp4"},
+		{"no extension", "movie", false, []string{"movie"}, "movie (2)"},
+		{"segments", "movie_%03d.mp4", true, []string{"movie_000.mp4"}, "movie (2)_%03d.mp4"},
+		{"segments taken", "movie_%03d.mp4", true, []string{"movie_000.mp4", "movie (2)_000.mp4"}, "movie (3)_%03d.mp4"},
+		// only the first segment tells whether a pattern is taken
+		{"later segments", "movie_%03d.mp4", true, []string{"movie_000.mp4", "movie (2)_001.mp4"}, "movie (2)_%03d.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := renamedOutput(filepath.Join(dir, tt.output), tt.segmented)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, tt.want); got != want {
+				t.Errorf("renamedOutput = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRenamedOutputDanglingLink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink(filepath.Join(dir, "gone.mp4"), filepath.Join(dir, "movie (2).mp4")); err != nil {
+		t.Skipf("can't symlink: %v", err)
+	}
+	got, err := renamedOutput(filepath.Join(dir, "movie.mp4"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writing through the link would create its target instead
+	if want := filepath.Join(dir, "movie (3).mp4"); got != want {
+		t.Errorf("renamedOutput = %q, want %q", got, want)
+	}
+}
+
+func TestRenamedOutputExhausted(t *testing.T) {
+	dir := t.TempDir()
+	for n := 2; n <= maxRenames; n++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("movie (%d).mp4", n)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := renamedOutput(filepath.Join(dir, "movie.mp4"), false); !errors.Is(err, ErrOutputExists) {
+		t.Errorf("renamedOutput = %q, %v, want ErrOutputExists", got, err)
+	}
+}
+
+func TestKeptOutput(t *testing.T) {
+	tests := []struct {
+		onExisting string
+		err        error
+		want       bool
+	}{
+		{existingSkip, fmt.Errorf("%w: movie.mp4", ErrOutputExists), true},
+		{existingError, fmt.Errorf("%w: movie.mp4", ErrOutputExists), false},
+		{existingError, ErrUpToDate, true},
+		{existingOverwrite, fmt.Errorf("wrapped: %w", ErrUpToDate), true},
+		{existingSkip, ErrSourceCorrupt, false},
+		{existingSkip, nil, false},
+	}
+	for _, tt := range tests {
+		w := &worker{onExisting: tt.onExisting}
+		if got := w.keptOutput(tt.err); got != tt.want {
+			t.Errorf("keptOutput(%v) with -on-existing %s = %v, want %v", tt.err, tt.onExisting, got, tt.want)
+		}
+	}
+}
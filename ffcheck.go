@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ffmpegVersionRE matches the version of a release build in the first line
+// of ffmpeg -version, e.g. "ffmpeg version 6.1.1-3ubuntu5" or "n7.0".
+var ffmpegVersionRE = regexp.MustCompile(`^ffmpeg version n?(\d+(?:\.\d+)*)`)
+
+// parseVersion splits a version such as 6.1.1 into its numbers.
+func parseVersion(s string) ([]int, error) {
+	var nums []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q (expected e.g. 6.1)", s)
+		}
+		nums = append(nums, n)
+	}
+	return nums, nil
+}
+
+// olderVersion reports whether version a is older than b, treating missing
+// numbers as 0 so 6 is the same as 6.0.
+func olderVersion(a, b []int) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// encoders returns the encoders opts converts streams with, by the flag
+// choosing them.
+func (o *options) encoders() map[string]string {
+	enc := make(map[string]string)
+	if !o.videoCopied() {
+		enc[o.VideoCodec] = "-codec"
+	} else if o.TargetSize != "" {
+		enc[transcodeCodecs["video"]] = "-target-size"
+	} else if o.Compat != "" {
+		enc[transcodeCodecs["video"]] = "-compat"
+	}
+	if !o.audioCopied() {
+		enc[o.audioCodec()] = "-acodec"
+	} else if o.Compat != "" {
+		enc[transcodeCodecs["audio"]] = "-compat"
+	}
+	for _, ru := range o.Rules {
+		if ru.action != ruleCopy && ru.action != ruleDrop {
+			enc[ru.action] = "-rules"
+		}
+	}
+	if o.TranscodeMissing {
+		for _, codec := range transcodeCodecs {
+			enc[codec] = "-transcode-missing"
+		}
+	}
+	return enc
+}
+
+// checkFFmpeg checks that the ffmpeg run is at least version min, if it's
+// set, and has the encoders opts needs, returning the problems found.
+func checkFFmpeg(ctx context.Context, min string, opts options) ([]string, error) {
+	var problems []string
+	if min != "" {
+		want, err := parseVersion(min)
+		if err != nil {
+			return nil, fmt.Errorf("-min-ffmpeg: %v", err)
+		}
+		out, err := ffmpegCommand(ctx, "-hide_banner", "-version").Output()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+		}
+		first := string(bytes.SplitN(out, []byte("\n"), 2)[0])
+		if m := ffmpegVersionRE.FindStringSubmatch(first); m == nil {
+			// such as the N-12345-gabcdef of a build from git
+			problems = append(problems, fmt.Sprintf("can't tell whether %q is at least -min-ffmpeg %s", first, min))
+		} else if got, _ := parseVersion(m[1]); olderVersion(got, want) {
+			problems = append(problems, fmt.Sprintf("ffmpeg %s is older than -min-ffmpeg %s", m[1], min))
+		}
+	}
+
+	needed := opts.encoders()
+	if len(needed) == 0 {
+		return problems, nil
+	}
+	encoders, err := ffmpegCommand(ctx, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+	}
+	codecs, err := ffmpegCommand(ctx, "-hide_banner", "-codecs").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+	}
+	have := make(map[string]bool)
+	for _, fields := range listedLines(encoders) {
+		have[fields[1]] = true
+	}
+	// codecs such as h264 or mp3 are accepted in place of their encoders,
+	// and can be encoded when their flags have an E
+	for _, fields := range listedLines(codecs) {
+		if len(fields[0]) > 1 && fields[0][1] == 'E' {
+			have[fields[1]] = true
+		}
+	}
+	var missing []string
+	for codec, flag := range needed {
+		if !have[codec] {
+			missing = append(missing, fmt.Sprintf("this ffmpeg has no %s encoder or codec to encode (from %s)", codec, flag))
+		}
+	}
+	sort.Strings(missing)
+	return append(problems, missing...), nil
+}
+
+// listedLines returns the fields of the lines listed by ffmpeg -encoders or
+// -codecs, which follow a legend ending in a line of dashes. Each has at
+// least the flags and the name.
+func listedLines(out []byte) [][]string {
+	var lines [][]string
+	listed := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && listed {
+			lines = append(lines, fields)
+		} else if strings.HasPrefix(strings.TrimSpace(line), "---") {
+			listed = true
+		}
+	}
+	return lines
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// stderrTail is how much of the end of ffmpeg's stderr is kept to explain
+// a failure.
+const stderrTail = 8 << 10
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+// lastError returns the last line of ffmpeg's output describing an error.
+func (b *tailBuffer) lastError() string {
+	lines := strings.FieldsFunc(string(b.buf), func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" && line != "Conversion failed!" {
+			return line
+		}
+	}
+	return ""
+}
+
+// ffmpegMsgs are messages in ffmpeg's output telling the kind of a failure.
+var ffmpegMsgs = []struct {
+	msg  string
+	kind error
+}{
+	{"Could not find tag for codec", ErrIncompatibleCodec},
+	{"codec not currently supported in container", ErrIncompatibleCodec},
+	{"No space left on device", ErrDiskFull},
+	{"Connection timed out", ErrNetwork},
+	{"Connection refused", ErrNetwork},
+	{"Connection reset by peer", ErrNetwork},
+	{"Network is unreachable", ErrNetwork},
+	{"Stale file handle", ErrNetwork},
+	{"Device creation failed", ErrHWDevice},
+	{"No device available for decoder", ErrHWDevice},
+	{"No NVENC capable devices found", ErrHWDevice},
+	{"OpenEncodeSessionEx failed", ErrHWDevice},
+	{"Cannot load libcuda", ErrHWDevice},
+}
+
+// execWrapper is the -exec-wrapper command ffmpeg is run inside, such as
+// firejail or bwrap with its arguments, or nil to run ffmpeg directly.
+var execWrapper []string
+
+// ffmpegCommand returns the command running ffmpeg with args, inside
+// execWrapper if it's set.
+func ffmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	if len(execWrapper) == 0 {
+		return exec.CommandContext(ctx, "ffmpeg", args...)
+	}
+	argv := ffmpegCommandLine(args)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	killGroup(cmd)
+	return cmd
+}
+
+// ffmpegCommandLine returns the arguments of the command running ffmpeg
+// with args, starting with the program run.
+func ffmpegCommandLine(args []string) []string {
+	argv := append([]string(nil), execWrapper...)
+	argv = append(argv, "ffmpeg")
+	return append(argv, args...)
+}
+
+// runFFmpeg runs ffmpeg with args until it exits or ctx is done, removing
+// the partial output if it fails. ffmpeg reads stdin when it isn't nil.
+func runFFmpeg(ctx context.Context, args []string, stdin io.Reader, output string, opts options) error {
+	stderr := &tailBuffer{max: stderrTail}
+	var progress io.ReadCloser
+	if opts.progress != nil && !opts.Stdout {
+		args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	}
+	cmd := ffmpegCommand(ctx, args...)
+	cmd.Stdin = stdin
+	cmd.Stderr = stderr
+	if opts.Stdout {
+		cmd.Stdout = os.Stdout
+	} else if opts.progress != nil {
+		var err error
+		if progress, err = cmd.StdoutPipe(); err != nil {
+			return err
+		}
+	}
+	err := startPinned(cmd, opts.cpus)
+	if err == nil {
+		if progress != nil {
+			// read it all before Wait, which closes the pipe
+			opts.progress.readProgress(progress, opts.source, opts.duration)
+		}
+		err = cmd.Wait()
+	}
+	if err == nil {
+		return nil
+	}
+	if !opts.Stdout && isFileOutput(output) {
+		// don't leave a partial output behind to block a retry
+		os.Remove(output)
+	}
+	return ffmpegError(ctx, err, stderr)
+}
+
+// isFileOutput reports whether ffmpeg writes output to a file of its own,
+// rather than discarding it or writing it to a pipe or device that mustn't
+// be removed.
+func isFileOutput(output string) bool {
+	return output != nullOutput && output != os.DevNull && !strings.HasPrefix(output, "pipe:")
+}
+
+// ffmpegError describes the failure err of an ffmpeg run, wrapping one of
+// errorKinds when it can be told which.
+func ffmpegError(ctx context.Context, err error, stderr *tailBuffer) error {
+	if ctx.Err() != nil {
+		return ErrTimeout
+	} else if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+	}
+
+	if sig, ok := killedBySignal(err); ok {
+		if sig == syscall.SIGKILL {
+			// nothing here sends SIGKILL, so it's most likely the kernel
+			return fmt.Errorf("%w by signal %d (likely OOM); reduce -c or use -max-mem", ErrKilled, sig)
+		}
+		return fmt.Errorf("%w by signal %d (%v)", ErrKilled, sig, sig)
+	}
+
+	msg := stderr.lastError()
+	for _, m := range ffmpegMsgs {
+		if strings.Contains(string(stderr.buf), m.msg) {
+			return fmt.Errorf("%w: %s", m.kind, msg)
+		}
+	}
+	if msg != "" {
+		return fmt.Errorf("ffmpeg: %s (%v)", msg, err)
+	}
+	return err
+}
+
+// shellJoin joins args into a command line that a shell would split back
+// into args.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
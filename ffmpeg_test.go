@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFFmpegCommandLine(t *testing.T) {
+	args := []string{"-i", "my movie.mkv", "-codec", "copy", "out.mp4"}
+	tests := []struct {
+		name    string
+		wrapper string
+		want    []string
+	}{
+		{"no wrapper", "", []string{"ffmpeg", "-i", "my movie.mkv", "-codec", "copy", "out.mp4"}},
+		{"wrapper", "firejail --quiet --net=none",
+			[]string{"firejail", "--quiet", "--net=none", "ffmpeg", "-i", "my movie.mkv", "-codec", "copy", "out.mp4"}},
+		{"quoted wrapper", `bwrap --ro-bind / / --setenv LABEL "a b" --`,
+			[]string{"bwrap", "--ro-bind", "/", "/", "--setenv", "LABEL", "a b", "--", "ffmpeg", "-i", "my movie.mkv", "-codec", "copy", "out.mp4"}},
+	}
+	defer func() { execWrapper = nil }()
+	for _, tt := range tests {
+		execWrapper = nil
+		if tt.wrapper != "" {
+			var err error
+			if execWrapper, err = splitArgs(tt.wrapper); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if got := ffmpegCommandLine(args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ffmpegCommandLine = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := ffmpegCommand(context.Background(), args...).Args; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ffmpegCommand runs %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFFmpegCommandLineCopiesWrapper(t *testing.T) {
+	execWrapper = make([]string, 1, 8)
+	execWrapper[0] = "nice"
+	defer func() { execWrapper = nil }()
+
+	a := ffmpegCommandLine([]string{"-i", "a.mkv"})
+	b := ffmpegCommandLine([]string{"-i", "b.mkv"})
+	if a[len(a)-1] != "a.mkv" || b[len(b)-1] != "b.mkv" {
+		t.Errorf("command lines share the wrapper's array: %q and %q", a, b)
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ffmpeg", "-i", "in.mkv"}, "ffmpeg -i in.mkv"},
+		{[]string{"ffmpeg", "-i", "my movie.mkv"}, "ffmpeg -i 'my movie.mkv'"},
+		{[]string{"ffmpeg", "-metadata", "title=it's"}, `ffmpeg -metadata 'title=it'\''s'`},
+		{[]string{"ffmpeg", "-vf", "scale=-2:min(720\\,ih)"}, `ffmpeg -vf 'scale=-2:min(720\,ih)'`},
+		{[]string{"ffmpeg", ""}, "ffmpeg ''"},
+	}
+	for _, tt := range tests {
+		if got := shellJoin(tt.args); got != tt.want {
+			t.Errorf("shellJoin(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestIsFileOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"out.mp4", true},
+		{"/movies/out.mp4", true},
+		{nullOutput, false},
+		{os.DevNull, false},
+		{stdoutOutput, false},
+		{"pipe:0", false},
+	}
+	for _, tt := range tests {
+		if got := isFileOutput(tt.output); got != tt.want {
+			t.Errorf("isFileOutput(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
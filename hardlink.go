@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The -hardlink-policy values, deciding what's done with sources that have
+// more than one hard link.
+const (
+	linksSkip        = "skip"         // leave them alone
+	linksConvertOnce = "convert-once" // convert the first name found, skip the others
+	linksDeleteAll   = "delete-all"   // convert once, then remove every name found
+)
+
+// fileID identifies a file regardless of its name.
+type fileID struct {
+	dev, ino uint64
+}
+
+// linkTracker applies the -hardlink-policy. Links are only found within
+// root, or the source's directory without one. It's safe for concurrent
+// use.
+type linkTracker struct {
+	policy string
+	root   string
+
+	mu      sync.Mutex
+	seen    map[fileID]seenFile
+	removed map[string]string              // names removed with delete-all, to the name converted
+	names   map[string]map[fileID][]string // the names found of each file, by the root searched
+}
+
+// seenFile is a multiply linked file that was converted, by its first name.
+// The size and modification time tell it apart from a later file that
+// reuses its inode.
+type seenFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func newLinkTracker(policy, root string) (*linkTracker, error) {
+	switch policy {
+	case linksSkip, linksConvertOnce, linksDeleteAll:
+	default:
+		return nil, fmt.Errorf("unknown -hardlink-policy %q (expected skip, convert-once or delete-all)", policy)
+	}
+	return &linkTracker{policy: policy, root: root, seen: make(map[fileID]seenFile), removed: make(map[string]string), names: make(map[string]map[fileID][]string)}, nil
+}
+
+// check returns an error wrapping ErrHardlink if filename mustn't be
+// converted under the policy. Each source is checked once, before its
+// first attempt.
+func (t *linkTracker) check(filename string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if converted, ok := t.removed[filename]; ok {
+		return fmt.Errorf("%w: it was removed along with %s", ErrHardlink, converted)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil
+	}
+	id, n, ok := fileLinks(info)
+	if !ok {
+		return nil
+	}
+	// the other names may have been removed since, leaving only this one
+	if first, ok := t.seen[id]; ok && first.size == info.Size() && first.modTime.Equal(info.ModTime()) {
+		return fmt.Errorf("%w: it's the same file as %s", ErrHardlink, first.name)
+	}
+	if n < 2 {
+		return nil
+	} else if t.policy == linksSkip {
+		return fmt.Errorf("%w: it has %d links", ErrHardlink, n)
+	}
+	t.seen[id] = seenFile{name: filename, size: info.Size(), modTime: info.ModTime()}
+	return nil
+}
+
+// remove removes the converted source filename, along with its other links
+// with delete-all.
+func (t *linkTracker) remove(filename string, logger, errLogger *log.Logger) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	id, n, ok := fileLinks(info)
+	if t == nil || t.policy != linksDeleteAll || !ok || n < 2 {
+		logger.Printf("Removing %s\n", filename)
+		return os.Remove(filename)
+	}
+
+	names := t.links(id, filename)
+	if uint64(len(names)) < n {
+		errLogger.Printf("Warning: only found %d of the %d links of %s, the others are outside %s", len(names), n, filename, t.rootFor(filename))
+	}
+	for _, name := range names {
+		logger.Printf("Removing %s\n", name)
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.removed[name] = filename
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+func (t *linkTracker) rootFor(filename string) string {
+	if t.root != "" {
+		return t.root
+	}
+	return filepath.Dir(filename)
+}
+
+// links returns the names of the file id found under the root of filename,
+// which is searched once for every multiply linked file in it.
+func (t *linkTracker) links(id fileID, filename string) []string {
+	root := t.rootFor(filename)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byID, ok := t.names[root]
+	if !ok {
+		byID = make(map[fileID][]string)
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			if id, n, ok := fileLinks(info); ok && n > 1 {
+				byID[id] = append(byID[id], path)
+			}
+			return nil
+		})
+		t.names[root] = byID
+	}
+	var names []string
+	for _, name := range byID[id] {
+		if _, err := os.Stat(name); err == nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{filename}
+	}
+	return names
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// linkedFiles writes a.mkv in a temporary directory with a hard link b.mkv,
+// and an unlinked c.mkv, skipping t where links can't be told apart.
+func linkedFiles(t *testing.T) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	a := filepath.Join(dir, "a.mkv")
+	if err := ioutil.WriteFile(a, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, filepath.Join(dir, "b.mkv")); err != nil {
+		t.Skipf("can't hard link: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c.mkv"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, n, ok := fileLinks(info); !ok {
+		t.Skip("hard links aren't detected here")
+	} else if n != 2 {
+		t.Fatalf("a.mkv has %d links, want 2", n)
+	}
+	return dir
+}
+
+func TestLinkTrackerCheck(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   map[string]bool // whether each name in turn is skipped
+	}{
+		{linksSkip, map[string]bool{"a.mkv": true, "b.mkv": true, "c.mkv": false}},
+		{linksConvertOnce, map[string]bool{"a.mkv": false, "b.mkv": true, "c.mkv": false}},
+		{linksDeleteAll, map[string]bool{"a.mkv": false, "b.mkv": true, "c.mkv": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := linkedFiles(t)
+			links, err := newLinkTracker(tt.policy, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+				err := links.check(filepath.Join(dir, name))
+				if got := errors.Is(err, ErrHardlink); got != tt.want[name] {
+					t.Errorf("check(%s) = %v, want skipped %v", name, err, tt.want[name])
+				}
+			}
+		})
+	}
+}
+
+func TestLinkTrackerInodeReused(t *testing.T) {
+	dir := linkedFiles(t)
+	links, err := newLinkTracker(linksConvertOnce, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(dir, "a.mkv"), filepath.Join(dir, "b.mkv")
+	if err := links.check(a); err != nil {
+		t.Fatal(err)
+	}
+	// the same inode holding different content is a different file, such as
+	// one written after the first was removed
+	if err := ioutil.WriteFile(a, []byte("a new video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := links.check(b); err != nil {
+		t.Errorf("check(b.mkv) after its inode changed = %v, want it converted", err)
+	}
+}
+
+func TestLinkTrackerRemove(t *testing.T) {
+	tests := []struct {
+		policy string
+		kept   []string // the names left after removing a.mkv
+	}{
+		{linksConvertOnce, []string{"b.mkv", "c.mkv"}},
+		{linksDeleteAll, []string{"c.mkv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := linkedFiles(t)
+			links, err := newLinkTracker(tt.policy, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := filepath.Join(dir, "a.mkv")
+			if err := links.check(a); err != nil {
+				t.Fatal(err)
+			}
+			logger := log.New(ioutil.Discard, "", 0)
+			if err := links.remove(a, logger, logger); err != nil {
+				t.Fatal(err)
+			}
+			if got := dirNames(t, dir); !reflect.DeepEqual(got, tt.kept) {
+				t.Errorf("left %q, want %q", got, tt.kept)
+			}
+			if tt.policy == linksDeleteAll {
+				if err := links.check(filepath.Join(dir, "b.mkv")); !errors.Is(err, ErrHardlink) {
+					t.Errorf("check(b.mkv) after it was removed = %v, want it skipped", err)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkTrackerRemoveNil(t *testing.T) {
+	dir := linkedFiles(t)
+	var links *linkTracker
+	logger := log.New(ioutil.Discard, "", 0)
+	if err := links.remove(filepath.Join(dir, "a.mkv"), logger, logger); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dirNames(t, dir), []string{"b.mkv", "c.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+}
+
+func TestNewLinkTrackerPolicy(t *testing.T) {
+	for _, policy := range []string{linksSkip, linksConvertOnce, linksDeleteAll} {
+		if _, err := newLinkTracker(policy, ""); err != nil {
+			t.Errorf("newLinkTracker(%q) = %v", policy, err)
+		}
+	}
+	if _, err := newLinkTracker("keep-all", ""); err == nil {
+		t.Error("newLinkTracker accepted an unknown policy")
+	}
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Side data types of HDR10 metadata.
+const (
+	masteringDisplay  = "Mastering display metadata"
+	contentLightLevel = "Content light level metadata"
+)
+
+// hdrVideo returns the first video stream of p that isn't cover art.
+func hdrVideo(p *probeResult) (probeStream, bool) {
+	for _, st := range p.streams("video") {
+		if !isCover(st) {
+			return st, true
+		}
+	}
+	return probeStream{}, false
+}
+
+// isHDR reports whether st uses an HDR transfer function (PQ or HLG).
+func isHDR(st probeStream) bool {
+	return st.ColorTransfer == "smpte2084" || st.ColorTransfer == "arib-std-b67"
+}
+
+// sideData returns st's side data of type t.
+func (st probeStream) sideData(t string) (probeSideData, bool) {
+	for _, sd := range st.SideData {
+		if sd.Type == t {
+			return sd, true
+		}
+	}
+	return probeSideData{}, false
+}
+
+// colorArgs returns the arguments tagging the output with st's colors.
+func colorArgs(st probeStream) []string {
+	var args []string
+	for _, c := range []struct{ flag, value string }{
+		{"-color_primaries", st.ColorPrimaries},
+		{"-color_trc", st.ColorTransfer},
+		{"-colorspace", st.ColorSpace},
+	} {
+		if c.value != "" && c.value != "unknown" {
+			args = append(args, c.flag, c.value)
+		}
+	}
+	return args
+}
+
+// x265HDRParams returns the -x265-params carrying st's HDR10 side data into
+// a libx265 encode, or "" if it has none. x265 takes chromaticities in units
+// of 0.00002 and luminances in units of 0.0001 cd/m².
+func x265HDRParams(st probeStream) string {
+	var params string
+	if md, ok := st.sideData(masteringDisplay); ok {
+		c := func(r string) int64 { return scaleRational(r, 50000) }
+		l := func(r string) int64 { return scaleRational(r, 10000) }
+		params = fmt.Sprintf("master-display=G(%d,%d)B(%d,%d)R(%d,%d)WP(%d,%d)L(%d,%d)",
+			c(md.GreenX), c(md.GreenY), c(md.BlueX), c(md.BlueY), c(md.RedX), c(md.RedY),
+			c(md.WhitePointX), c(md.WhitePointY), l(md.MaxLuminance), l(md.MinLuminance))
+	}
+	if cll, ok := st.sideData(contentLightLevel); ok {
+		if params != "" {
+			params += ":"
+		}
+		params += fmt.Sprintf("max-cll=%d,%d", cll.MaxContent, cll.MaxAverage)
+	}
+	if params != "" {
+		params = "hdr10-opt=1:" + params
+	}
+	return params
+}
+
+// scaleRational returns the rational r, such as "34000/50000", multiplied by
+// unit and rounded, or 0 if r isn't a rational.
+func scaleRational(r string, unit int64) int64 {
+	v, ok := new(big.Rat).SetString(r)
+	if !ok {
+		return 0
+	}
+	v.Mul(v, big.NewRat(unit, 1))
+	f, _ := v.Float64()
+	return int64(f + 0.5)
+}
+
+// hdrArgs returns the arguments carrying the HDR metadata of p's video into
+// the output.
+func (o *options) hdrArgs(p *probeResult) []string {
+	st, ok := hdrVideo(p)
+	if !ok || !isHDR(st) {
+		return nil
+	}
+	args := colorArgs(st)
+	if o.VideoCodec == "libx265" {
+		if params := x265HDRParams(st); params != "" {
+			args = append(args, "-x265-params", params)
+		}
+	}
+	return args
+}
+
+// droppedHDR returns the HDR metadata of src's video that out's is missing.
+func droppedHDR(src, out *probeResult) []string {
+	s, ok := hdrVideo(src)
+	if !ok || !isHDR(s) {
+		return nil
+	}
+	o, _ := hdrVideo(out)
+	var dropped []string
+	if o.ColorPrimaries != s.ColorPrimaries {
+		dropped = append(dropped, "color primaries")
+	}
+	if o.ColorTransfer != s.ColorTransfer {
+		dropped = append(dropped, "transfer characteristics")
+	}
+	if o.ColorSpace != s.ColorSpace {
+		dropped = append(dropped, "color space")
+	}
+	for _, t := range []string{masteringDisplay, contentLightLevel} {
+		_, had := s.sideData(t)
+		if _, has := o.sideData(t); had && !has {
+			dropped = append(dropped, strings.ToLower(t))
+		}
+	}
+	return dropped
+}
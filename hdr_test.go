@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// hdrProbe is ffprobe's output for an HDR10 HEVC source with cover art
+// ahead of its video.
+const hdrProbe = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "mjpeg", "disposition": {"attached_pic": 1}},
+		{
+			"index": 1, "codec_type": "video", "codec_name": "hevc", "width": 3840, "height": 2160,
+			"color_primaries": "bt2020", "color_transfer": "smpte2084", "color_space": "bt2020nc",
+			"side_data_list": [
+				{
+					"side_data_type": "Mastering display metadata",
+					"red_x": "34000/50000", "red_y": "16000/50000",
+					"green_x": "13250/50000", "green_y": "34500/50000",
+					"blue_x": "7500/50000", "blue_y": "3000/50000",
+					"white_point_x": "15635/50000", "white_point_y": "16450/50000",
+					"min_luminance": "50/10000", "max_luminance": "10000000/10000"
+				},
+				{"side_data_type": "Content light level metadata", "max_content": 1000, "max_average": 400}
+			]
+		},
+		{"index": 2, "codec_type": "audio", "codec_name": "eac3"}
+	]
+}`
+
+func TestHDRProbeParsing(t *testing.T) {
+	p := parseProbe(t, hdrProbe)
+	st, ok := hdrVideo(p)
+	if !ok {
+		t.Fatal("hdrVideo found no video")
+	} else if st.Index != 1 {
+		t.Fatalf("hdrVideo picked stream %d, want 1 past the cover art", st.Index)
+	}
+	if !isHDR(st) {
+		t.Errorf("isHDR = false for transfer %q", st.ColorTransfer)
+	}
+
+	md, ok := st.sideData(masteringDisplay)
+	if !ok {
+		t.Fatal("no mastering display side data")
+	} else if md.RedX != "34000/50000" || md.WhitePointY != "16450/50000" || md.MaxLuminance != "10000000/10000" {
+		t.Errorf("mastering display = %+v", md)
+	}
+	cll, ok := st.sideData(contentLightLevel)
+	if !ok {
+		t.Fatal("no content light level side data")
+	} else if cll.MaxContent != 1000 || cll.MaxAverage != 400 {
+		t.Errorf("content light level = %d,%d, want 1000,400", cll.MaxContent, cll.MaxAverage)
+	}
+
+	want := "hdr10-opt=1:master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,400"
+	if got := x265HDRParams(st); got != want {
+		t.Errorf("x265HDRParams = %q, want %q", got, want)
+	}
+}
+
+func TestHDRArgs(t *testing.T) {
+	p := parseProbe(t, hdrProbe)
+	colors := []string{"-color_primaries", "bt2020", "-color_trc", "smpte2084", "-colorspace", "bt2020nc"}
+	tests := []struct {
+		codec string
+		want  []string
+	}{
+		{"copy", colors},
+		{"libx264", colors},
+		{"libx265", append(append([]string(nil), colors...), "-x265-params",
+			"hdr10-opt=1:master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,400")},
+	}
+	for _, tt := range tests {
+		o := defaultOptions
+		o.VideoCodec = tt.codec
+		if got := o.hdrArgs(p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hdrArgs with %s = %q, want %q", tt.codec, got, tt.want)
+		}
+	}
+
+	sdr := parseProbe(t, `{"streams": [{"codec_type": "video", "color_transfer": "bt709"}]}`)
+	if got := defaultOptions.hdrArgs(sdr); got != nil {
+		t.Errorf("hdrArgs of SDR video = %q, want none", got)
+	}
+}
+
+func TestIsHDR(t *testing.T) {
+	tests := []struct {
+		transfer string
+		want     bool
+	}{
+		{"smpte2084", true},
+		{"arib-std-b67", true},
+		{"bt709", false},
+		{"unknown", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isHDR(probeStream{ColorTransfer: tt.transfer}); got != tt.want {
+			t.Errorf("isHDR(%q) = %v, want %v", tt.transfer, got, tt.want)
+		}
+	}
+}
+
+func TestColorArgs(t *testing.T) {
+	st := probeStream{ColorPrimaries: "bt2020", ColorTransfer: "arib-std-b67", ColorSpace: "unknown"}
+	want := []string{"-color_primaries", "bt2020", "-color_trc", "arib-std-b67"}
+	if got := colorArgs(st); !reflect.DeepEqual(got, want) {
+		t.Errorf("colorArgs = %q, want %q", got, want)
+	}
+}
+
+func TestScaleRational(t *testing.T) {
+	tests := []struct {
+		r    string
+		unit int64
+		want int64
+	}{
+		{"34000/50000", 50000, 34000},
+		{"1/3", 50000, 16667},
+		{"50/10000", 10000, 50},
+		{"0.005", 10000, 50},
+		{"", 10000, 0},
+		{"n/a", 10000, 0},
+	}
+	for _, tt := range tests {
+		if got := scaleRational(tt.r, tt.unit); got != tt.want {
+			t.Errorf("scaleRational(%q, %d) = %d, want %d", tt.r, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestDroppedHDR(t *testing.T) {
+	src := parseProbe(t, hdrProbe)
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"kept", hdrProbe, nil},
+		{"side data dropped", `{"streams": [{"codec_type": "video", "color_primaries": "bt2020", "color_transfer": "smpte2084", "color_space": "bt2020nc"}]}`,
+			[]string{"mastering display metadata", "content light level metadata"}},
+		{"colors dropped", `{"streams": [{"codec_type": "video", "side_data_list": [
+			{"side_data_type": "Mastering display metadata"}, {"side_data_type": "Content light level metadata"}]}]}`,
+			[]string{"color primaries", "transfer characteristics", "color space"}},
+	}
+	for _, tt := range tests {
+		if got := droppedHDR(src, parseProbe(t, tt.out)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: droppedHDR = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	sdr := parseProbe(t, `{"streams": [{"codec_type": "video", "color_transfer": "bt709"}]}`)
+	if got := droppedHDR(sdr, sdr); got != nil {
+		t.Errorf("droppedHDR of SDR video = %q, want none", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// postHook is a command run after each successful conversion. The source
+// and output paths are appended to its arguments and set in MKV2MP4_SRC and
+// MKV2MP4_DST.
+type postHook struct {
+	args     []string
+	timeout  time.Duration
+	required bool // a failing hook fails the conversion
+}
+
+func (h *postHook) run(ctx context.Context, src, dst string, logger *log.Logger) error {
+	parent := ctx
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.args[0], append(h.args[1:], src, dst)...)
+	cmd.Env = append(os.Environ(), "MKV2MP4_SRC="+src, "MKV2MP4_DST="+dst)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			logger.Printf("post-hook: %s\n", line)
+		}
+	}
+	// a -deadline passing or the run stopping also ends the hook, which isn't
+	// its -hook-timeout
+	if parent.Err() != nil {
+		return fmt.Errorf("%w: stopped: %v", ErrHook, parent.Err())
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: timed out after %s", ErrHook, h.timeout)
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", ErrHook, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// inFlight is the set of sources queued or being converted, so the same file
+// is never handled by two workers at once. It's safe for concurrent use.
+type inFlight struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{paths: make(map[string]bool)}
+}
+
+func inFlightKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// add records path, returning false if it's already in flight.
+func (f *inFlight) add(path string) bool {
+	key := inFlightKey(path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paths[key] {
+		return false
+	}
+	f.paths[key] = true
+	return true
+}
+
+func (f *inFlight) remove(path string) {
+	key := inFlightKey(path)
+	f.mu.Lock()
+	delete(f.paths, key)
+	f.mu.Unlock()
+}
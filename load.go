@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// loadCheckInterval is how often a busy system's load is read again.
+const loadCheckInterval = 5 * time.Second
+
+// loadGate holds back new conversions while the system's load average is at
+// or above max. It's safe for concurrent use.
+type loadGate struct {
+	max    float64
+	logger *log.Logger
+
+	mu   sync.Mutex
+	busy bool
+}
+
+// check reports whether the load is too high to start a conversion, logging
+// any change. It reports false where the load can't be read.
+func (g *loadGate) check() bool {
+	load, ok := loadAverage()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	busy := ok && load >= g.max
+	if busy != g.busy {
+		if busy {
+			g.logger.Printf("Load average %.2f is at least -max-load %g, no new conversions will start\n", load, g.max)
+		} else {
+			g.logger.Printf("Load average %.2f is below -max-load %g, resuming\n", load, g.max)
+		}
+		g.busy = busy
+	}
+	return busy
+}
+
+// wait blocks while the load is too high. It returns false if ctx is done
+// first.
+func (g *loadGate) wait(ctx context.Context) bool {
+	for g.check() {
+		select {
+		case <-time.After(loadCheckInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+const loadSupported = false
+
+// loadAverage isn't supported on this platform.
+func loadAverage() (float64, bool) {
+	return 0, false
+}
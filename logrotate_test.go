@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOpenLogFileAppends(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+	}{
+		{"plain", 0},
+		{"rotating", 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mkv2mp4.log")
+			for _, line := range []string{"first run\n", "second run\n"} {
+				f, err := openLogFile(path, tt.maxSize, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "first run\nsecond run\n"; string(got) != want {
+				t.Errorf("log = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenLogFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't keep Unix permissions")
+	}
+	path := filepath.Join(t.TempDir(), "mkv2mp4.log")
+	f, err := openLogFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the umask may take away group and other bits, but never add any
+	if perm := info.Mode().Perm(); perm&0600 != 0600 || perm&^0644 != 0 {
+		t.Errorf("permissions = %v, want at most 0644 and at least 0600", perm)
+	}
+}
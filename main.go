@@ -2,163 +2,1554 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// job is a single file queued for conversion. A nil opts means the worker's
+// default options are used.
+type job struct {
+	id       string
+	source   string
+	opts     *options
+	priority int // set by POST /convert, for -priority tag
+}
+
+// exitDeadline is the exit status of a run cut short by -deadline.
+const exitDeadline = 3
+
 type worker struct {
-	work      <-chan string
+	id        int
+	queue     *jobQueue
+	pause     *pauser // holds back new conversions with -serve
+	load      *loadGate
+	tuner     *concurrencyTuner // picks how many workers convert with -auto-concurrency
 	ctx       context.Context
+	deadline  context.Context // running conversions are killed once it's done
 	logger    *log.Logger
 	errLogger *log.Logger
 	done      chan<- struct{}
+	opts      options
+	report    *csvReport
+	jobs      *jobTracker
+	outputMap prefixMap
+	outSubdir string
+	outFile   string // the -out path of the single -f file
+	// incremental skips sources whose outputs are newer, leaving older
+	// outputs to onExisting
+	incremental bool
+	onExisting  string // what's done with existing outputs, e.g. existingSkip
+	segment     string // the -segment duration in seconds
+	idetSample  time.Duration
+	cpus        []int // with -affinity
+
+	verifyOnly bool
+	dryRun     bool
+	estimate   *estimate // projects the -dry-run's time and space
+	manifest   manifest  // the sources' expected digests, or nil
+	deletes    *deleteCap
+	links      *linkTracker
+	renditions renditionList
+	containers containerModes // with -by-container
+	progress   *progressStream
+	nfoFormat  string // the -write-nfo sidecar's format, or ""
+	outSums    *manifestWriter
+	postHook   *postHook
+	confirm    *confirmer
+	removals   *removalQueue // with -two-phase
+	summary    *summary
+	disks      *diskLimiter
+	minFree    int64  // bytes left free on the output's disk
+	minInodes  uint64 // inodes left free on the output's disk
+	inFlight   *inFlight
+	retry      retryPolicy
+	readRate   int64  // bytes per second, or 0 for no limit
+	tempDir    string // where outputs are written until done, "" for beside them
+	tempSuffix string
+	sink       Sink   // where outputs are uploaded to, or nil to keep them
+	sinkRoot   string // the -d directory sink keys are relative to
+	uploaded   int64  // bytes of the current attempt's outputs uploaded and removed
+
+	// faststartDir is where -faststart outputs are written with
+	// -faststart-local, "" to treat them like the others
+	faststartDir string
+	// splitChapters converts each chapter of a source into its own output
+	splitChapters bool
+	// resume carries on from the segments or parts an interrupted run left
+	resume bool
+
+	// stopDispatch is called once the outputs total quota bytes
+	quota        int64
+	stopDispatch func()
 }
 
+// listen converts queued jobs until the queue is closed and empty, holding
+// back while w.pause is paused or the load is above -max-load.
 func (w *worker) listen() {
 	for {
-		select {
-		case work := <-w.work:
-			err := w.convertFile(work)
-			if err != nil {
-				w.errLogger.Printf("Error converting %s: %v", work, err)
+		if w.tuner != nil && !w.tuner.wait(w.ctx, w.id) {
+			break
+		}
+		if w.pause != nil && !w.pause.wait(w.ctx) {
+			break
+		}
+		if w.load != nil && !w.load.wait(w.ctx) {
+			break
+		}
+		j, ok := w.queue.pop()
+		if !ok {
+			if w.tuner != nil {
+				// nothing's left for the workers it holds back either
+				w.tuner.close()
+			}
+			break
+		}
+		w.process(j)
+	}
+	w.done <- struct{}{}
+}
+
+// process converts a single file and records the result.
+func (w *worker) process(j job) {
+	opts := w.opts
+	if j.opts != nil {
+		opts = *j.opts
+	}
+	if w.jobs != nil && j.id != "" {
+		w.jobs.start(j.id)
+	}
+
+	filename := j.source
+	defer w.inFlight.remove(filename)
+	res := result{source: filename, status: statusConverted}
+	if info, err := os.Stat(filename); err == nil {
+		res.sourceSize = info.Size()
+	}
+
+	var finals []string
+	w.uploaded = 0
+	start := time.Now()
+	if w.verifyOnly {
+		res.status = statusVerified
+		w.logger.Printf("Verifying %s\n", filename)
+		if _, res.err = verifyFile(filename); res.err != nil {
+			w.errLogger.Printf("Error verifying %s: %v", filename, res.err)
+		}
+	} else {
+		var overrides []string
+		if w.links != nil {
+			res.err = w.links.check(filename)
+		}
+		if res.err == nil {
+			res.err = checkReadable(filename)
+		}
+		if res.err == nil {
+			opts, overrides, res.err = applySidecar(filename, opts)
+		}
+		if res.err == nil {
+			if len(overrides) > 0 {
+				w.logger.Printf("Using %s%s overrides: %s\n", filename, sidecarExt, strings.Join(overrides, ", "))
+			}
+			if res.err = opts.checkRequired(filename); res.err == nil {
+				finals, res.err = w.convertWithRetries(filename, opts)
 			}
+			if len(finals) > 0 {
+				res.output = finals[0]
+			}
+		}
+		switch {
+		case errors.Is(res.err, ErrUnreadable):
+			res.status = statusUnreadable
+			w.errLogger.Printf("Skipping %s: %v", filename, res.err)
+		case errors.Is(res.err, ErrNoVideo) || errors.Is(res.err, ErrNoAudio):
+			res.status = statusNoStream
+			w.errLogger.Printf("Skipping %s: %v", filename, res.err)
+		case errors.Is(res.err, ErrSourceCorrupt) || w.keptOutput(res.err) || errors.Is(res.err, ErrHardlink):
+			res.status = statusSkipped
+			w.errLogger.Printf("Skipping %s: %v", filename, res.err)
+		case res.err != nil:
+			w.errLogger.Printf("Error converting %s: %v", filename, res.err)
+		}
+	}
+	res.duration = time.Since(start)
+	if res.err != nil && res.status != statusSkipped && res.status != statusUnreadable && res.status != statusNoStream {
+		res.status = statusFailed
+	} else if res.err == nil && w.dryRun {
+		res.status = statusPlanned
+	}
+	for _, final := range finals {
+		if res.status == statusFailed {
+			// what a failure names may be the source itself
+			break
+		}
+		if outputs, err := w.outputFiles(final); err == nil {
+			for _, out := range outputs {
+				if info, err := os.Stat(out); err == nil {
+					res.outputSize += info.Size()
+				}
+			}
+		}
+	}
+	if res.status != statusFailed {
+		res.outputSize += w.uploaded
+	}
+
+	if w.tuner != nil {
+		w.tuner.record(res)
+	}
+	if total := w.summary.add(res); w.quota > 0 && total >= w.quota {
+		w.summary.stop(fmt.Sprintf("output size quota of %s reached", formatSize(w.quota)))
+		w.stopDispatch()
+	}
+
+	if w.report != nil {
+		if err := w.report.add(res); err != nil {
+			w.errLogger.Printf("Error writing report: %v", err)
+		}
+	}
+	if w.jobs != nil && j.id != "" {
+		w.jobs.finish(j.id, res)
+	}
+}
+
+// convertWithRetries converts filename, retrying failures per w.retry. It
+// gives up early if the run is cancelled while waiting to retry.
+func (w *worker) convertWithRetries(filename string, opts options) ([]string, error) {
+	for attempt := 1; ; attempt++ {
+		// a retry uploads its outputs again
+		w.uploaded = 0
+		outputs, err := w.convertFile(filename, opts)
+		retries := w.retry.retriesFor(err)
+		if err == nil || attempt > retries {
+			return outputs, err
+		}
+
+		delay := w.retry.delay(attempt)
+		w.errLogger.Printf("Error converting %s (attempt %d of %d): %v, retrying in %s",
+			filename, attempt, retries+1, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
 		case <-w.ctx.Done():
-			w.done <- struct{}{}
-			return
+			return outputs, err
 		}
 	}
 }
 
-func (w *worker) convertFile(filename string) error {
-	newFileName := strings.Replace(filename, ".mkv", ".mp4", 1)
+// outputPath returns where filename is converted to.
+func (w *worker) outputPath(filename string, opts options) string {
+	if opts.Stdout {
+		return stdoutOutput
+	}
+	ext := opts.outputExt()
+	if opts.MatchCase {
+		ext = matchCase(filename, ext)
+	}
+	if w.outFile != "" {
+		return w.outFile
+	}
+	out := outputName(filename, opts.suffix+ext)
+	if w.outSubdir != "" {
+		out = filepath.Join(filepath.Dir(out), w.outSubdir, filepath.Base(out))
+	}
+	if mapped, ok := w.outputMap.apply(out); ok {
+		out = mapped
+	}
+	if w.segment != "" {
+		return segmentPattern(out)
+	}
+	return out
+}
+
+// convertFile converts filename into its output, or each of its parts, and
+// removes it once every output is done. It returns the outputs' names, which
+// -on-existing rename may have changed, or on failure the failed one's.
+func (w *worker) convertFile(filename string, opts options) ([]string, error) {
+	// before anything touches an existing output, which a source failing
+	// its checksum mustn't replace
+	if w.manifest != nil {
+		if err := w.manifest.verify(filename); err != nil {
+			return []string{w.outputPath(filename, opts)}, err
+		}
+	}
+	kind, parts, err := w.parts(filename, opts)
+	if err != nil {
+		return []string{w.outputPath(filename, opts)}, err
+	}
+	if len(parts) == 0 {
+		if w.splitChapters {
+			w.errLogger.Printf("Warning: %s has no chapters, converting it whole", filename)
+		}
+		out, err := w.convertOutput(filename, opts)
+		if err != nil || w.dryRun {
+			return []string{out}, err
+		}
+		return []string{out}, w.removeSource(filename, opts)
+	}
+
+	var outputs, kept []string
+	why := ErrUpToDate // why every part was kept, if they all were
+	for _, p := range parts {
+		if out := w.outputPath(filename, p.opts); w.resume && w.partDone(out) {
+			w.logger.Printf("Keeping %s from an earlier run\n", out)
+			outputs = append(outputs, out)
+			continue
+		}
+		out, err := w.convertOutput(filename, p.opts)
+		if w.keptOutput(err) {
+			if errors.Is(err, ErrOutputExists) {
+				why = ErrOutputExists
+			}
+			kept = append(kept, out)
+			continue
+		} else if err != nil {
+			// start over on a retry rather than mixing parts of
+			// different attempts, unless resuming from them
+			if !w.resume {
+				for _, done := range outputs {
+					os.Remove(done)
+				}
+			}
+			return []string{out}, fmt.Errorf("%s: %w", p.name, err)
+		}
+		outputs = append(outputs, out)
+	}
+	if len(outputs) == 0 {
+		return kept, fmt.Errorf("%w: all %s", why, kind)
+	}
+	outputs = append(outputs, kept...)
+	if w.dryRun {
+		return outputs, nil
+	}
+	return outputs, w.removeSource(filename, opts)
+}
+
+// parts returns the outputs filename is converted into with -rendition or
+// -split-chapters, and what they are, or none for a single output.
+func (w *worker) parts(filename string, opts options) (string, []part, error) {
+	if w.splitChapters {
+		p, err := probe(filename)
+		if err != nil {
+			return "", nil, fmt.Errorf("probing source: %v", err)
+		}
+		return "chapters", chapterParts(p.Chapters, opts), nil
+	}
+	var parts []part
+	for _, r := range w.renditions {
+		parts = append(parts, part{name: "rendition " + r.name, opts: r.apply(opts)})
+	}
+	return "renditions", parts, nil
+}
+
+// convertOutput converts filename into a single output with opts, leaving
+// the source in place, and returns the output's name.
+func (w *worker) convertOutput(filename string, opts options) (string, error) {
+	opts.device = opts.deviceFor(w.id)
+	opts.segment = w.segment
+	opts.cpus = w.cpus
+	if w.containers != nil {
+		var mode string
+		if opts, mode = w.containers.apply(filename, opts); mode != "" && mode != containerCopy {
+			w.logger.Printf("Converting %s with -by-container mode %s\n", filename, mode)
+		}
+	}
+	if w.removals != nil {
+		opts.Verify = true
+	}
+	newFileName := w.outputPath(filename, opts)
+	if newFileName == filename {
+		return newFileName, fmt.Errorf("output would overwrite the source")
+	}
+	srcInfo, err := os.Stat(filename)
+	if err != nil {
+		return newFileName, err
+	}
+	resumed := false
+	if w.resume && w.segment != "" {
+		if resumed, opts, err = w.resumeSegments(filename, newFileName, opts); err != nil {
+			return newFileName, err
+		}
+	}
+	existing := newFileName
+	if w.segment != "" {
+		existing = firstSegment(newFileName)
+	}
+	if outInfo, err := os.Stat(existing); err == nil && !resumed {
+		switch {
+		case w.incremental && !srcInfo.ModTime().After(outInfo.ModTime()):
+			return newFileName, fmt.Errorf("%w: %s", ErrUpToDate, newFileName)
+		case w.onExisting == existingSkip, w.onExisting == existingError:
+			return newFileName, fmt.Errorf("%w: %s", ErrOutputExists, newFileName)
+		case w.onExisting == existingRename:
+			renamed, err := renamedOutput(newFileName, w.segment != "")
+			if err != nil {
+				return newFileName, err
+			}
+			w.logger.Printf("%s exists, writing %s instead\n", newFileName, renamed)
+			newFileName = renamed
+		case w.dryRun:
+		default:
+			if w.incremental {
+				w.logger.Printf("Replacing %s, which is older than its source\n", newFileName)
+			} else {
+				w.logger.Printf("Replacing %s\n", newFileName)
+			}
+			if w.segment != "" {
+				removeSegments(newFileName)
+			} else if err := os.Remove(newFileName); err != nil {
+				return newFileName, err
+			}
+		}
+	}
+
+	var srcProbe *probeResult
+	if opts.Verify || opts.needsProbe() {
+		if srcProbe, err = probe(filename); err != nil {
+			return newFileName, fmt.Errorf("probing source: %v", err)
+		}
+		if opts.PreserveAll {
+			if err := uncopyable(srcProbe); err != nil {
+				return newFileName, err
+			}
+		}
+		if missing := opts.missingLangs(srcProbe); len(missing) > 0 {
+			w.logger.Printf("%s has no %s streams\n", filename, strings.Join(missing, " or "))
+		}
+	}
+
+	if w.progress != nil {
+		opts.progress, opts.source = w.progress, filename
+		if d := opts.clipDuration(); d > 0 {
+			opts.duration = d
+		} else if p := srcProbe; p != nil {
+			opts.duration = p.duration()
+		} else if p, err := probe(filename); err == nil {
+			opts.duration = p.duration()
+		}
+	}
+
+	// ffmpeg writes to a temporary file that's moved into place once it's
+	// done, so a partial output is never mistaken for a finished one
+	output := newFileName
+	if !opts.Stdout && w.segment == "" {
+		output, opts.format = w.tempPath(newFileName, opts)
+	}
+	if opts.Deinterlace && !opts.AudioOnly {
+		if interlaced, err := w.isInterlaced(filename, w.idetSample); err != nil {
+			w.errLogger.Printf("Warning: couldn't detect whether %s is interlaced: %v", filename, err)
+		} else if interlaced {
+			w.logger.Printf("%s is interlaced, deinterlacing it\n", filename)
+			opts.deinterlace = true
+			if opts.videoCopied() {
+				opts.VideoCodec = transcodeCodecs["video"]
+			}
+		}
+	}
+
+	opts = opts.withCompat()
+	if opts.TargetSize != "" {
+		if opts, err = w.applyTargetSize(filename, opts, srcProbe); err != nil {
+			return newFileName, err
+		}
+	}
+
+	if w.dryRun {
+		fmt.Printf("%s -> %s: %s\n", filename, newFileName, shellJoin(ffmpegCommandLine(ffmpegArgs(opts, srcProbe, filename, output))))
+		if w.estimate != nil {
+			w.estimateFile(filename, srcProbe, opts)
+		}
+		return newFileName, nil
+	}
+	if output != newFileName {
+		// left behind by a run that was killed, or a failed move
+		os.Remove(output)
+		defer os.Remove(output)
+	}
+	if !opts.Stdout {
+		if err := os.MkdirAll(filepath.Dir(newFileName), 0755); err != nil {
+			return newFileName, err
+		}
+		if w.minFree > 0 || w.minInodes > 0 {
+			dirs := []string{filepath.Dir(output)}
+			if d := filepath.Dir(newFileName); d != dirs[0] {
+				dirs = append(dirs, d)
+			}
+			for _, d := range dirs {
+				if err := checkFree(d, w.minFree, w.minInodes); err != nil {
+					return newFileName, err
+				}
+			}
+		}
+	}
+
+	if w.disks != nil {
+		release, err := w.disks.acquire(w.deadline, srcInfo)
+		if err != nil {
+			return newFileName, err
+		}
+		defer release()
+	}
+
+	if opts.ValidateInput != "" {
+		w.logger.Printf("Validating %s\n", filename)
+		if err := w.validateInput(filename, opts.ValidateInput); err != nil {
+			return newFileName, err
+		}
+	}
+
+	opts, cleanup, err := w.firstPass(filename, opts, srcProbe)
+	if err != nil {
+		return newFileName, err
+	}
+	defer cleanup()
 	w.logger.Printf("Converting %s to %s\n", filename, newFileName)
-	cmd := exec.Command("ffmpeg", "-i", filename, "-codec", "copy", newFileName)
-	if err := cmd.Run(); err != nil {
+	err = w.ffmpeg(opts, srcProbe, filename, output)
+	if opts.TranscodeMissing {
+		err = w.transcodeMissing(filename, output, opts, srcProbe, err)
+	}
+	if err != nil {
+		if w.segment != "" && !w.resume {
+			removeSegments(output)
+		}
+		return newFileName, err
+	}
+	outputs, err := w.outputFiles(output)
+	if err != nil {
+		return newFileName, err
+	}
+
+	if opts.Verify {
+		var outProbe *probeResult
+		for _, out := range outputs {
+			if outProbe, err = verifyFile(out); err != nil {
+				if w.segment != "" {
+					// the source is only removed once every segment is fine
+					removeSegments(output)
+				}
+				return newFileName, fmt.Errorf("verifying %s: %v", out, err)
+			}
+		}
+		if opts.Chapters && w.segment == "" && len(outProbe.Chapters) < len(srcProbe.Chapters) {
+			w.errLogger.Printf("Warning: %s has %d chapters but %s only has %d",
+				filename, len(srcProbe.Chapters), newFileName, len(outProbe.Chapters))
+		}
+	}
+
+	if opts.HDR && opts.videoCopied() {
+		// a copy can't add what the muxer drops, so just say so
+		if outProbe, err := probe(outputs[0]); err != nil {
+			w.errLogger.Printf("Warning: couldn't check the HDR metadata of %s: %v", newFileName, err)
+		} else if dropped := droppedHDR(srcProbe, outProbe); len(dropped) > 0 {
+			w.errLogger.Printf("Warning: %s lost its %s", newFileName, strings.Join(dropped, ", "))
+		}
+	}
+
+	if output != newFileName {
+		if w.tempDirFor(opts) != "" {
+			w.logger.Printf("Moving %s to %s\n", output, newFileName)
+		}
+		if err := moveFile(output, newFileName); err != nil {
+			return newFileName, fmt.Errorf("moving output: %v", err)
+		}
+		outputs = []string{newFileName}
+		if opts.Faststart && w.faststartDir != "" {
+			if info, err := os.Stat(newFileName); err == nil {
+				// the second pass reads the whole output back and writes it again
+				w.logger.Printf("Ran the faststart pass of %s locally, sparing its destination about %s of I/O\n", newFileName, formatSize(2*info.Size()))
+			}
+		}
+	}
+
+	if opts.PreservePerms {
+		for _, out := range outputs {
+			if err := os.Chmod(out, srcInfo.Mode().Perm()); err != nil {
+				return newFileName, err
+			}
+			if err := copyOwner(srcInfo, out); err != nil {
+				w.errLogger.Printf("Warning: couldn't copy ownership of %s: %v", filename, err)
+			}
+		}
+	}
+	if (opts.PreserveTime || opts.Touch) && !opts.Stdout {
+		mtime := time.Now()
+		if opts.PreserveTime {
+			mtime = srcInfo.ModTime()
+		}
+		for _, out := range outputs {
+			if err := os.Chtimes(out, time.Now(), mtime); err != nil {
+				return newFileName, err
+			}
+		}
+	}
+	if w.outSums != nil && !opts.Stdout {
+		for _, out := range outputs {
+			if err := w.outSums.add(out); err != nil {
+				return newFileName, fmt.Errorf("adding %s to -manifest-out: %v", out, err)
+			}
+		}
+	}
+	if w.nfoFormat != "" && !opts.Stdout {
+		if nfo, err := writeNFO(outputs[0], w.nfoFormat); err != nil {
+			w.errLogger.Printf("Warning: couldn't write the %s of %s: %v", w.nfoFormat, newFileName, err)
+		} else {
+			outputs = append(outputs, nfo)
+		}
+	}
+	if w.postHook != nil && !opts.Stdout {
+		if err := w.postHook.run(w.ctx, filename, newFileName, w.logger); err != nil {
+			if w.postHook.required {
+				return newFileName, err
+			}
+			w.errLogger.Printf("Warning: %s: %v", filename, err)
+		}
+	}
+	if w.sink != nil && !opts.Stdout {
+		for _, out := range outputs {
+			if err := w.upload(out); err != nil {
+				return newFileName, err
+			}
+		}
+	}
+	return newFileName, nil
+}
+
+// removeSource removes filename once it's converted, unless opts or the
+// run's settings keep it.
+func (w *worker) removeSource(filename string, opts options) error {
+	if opts.AudioOnly || opts.Stdout || opts.Keep {
+		// the video is still only in the source, the output wasn't saved, or
+		// the source is wanted
+		return nil
+	}
+	if w.removals != nil {
+		w.logger.Printf("Keeping %s until every conversion is verified\n", filename)
+		w.removals.add(filename)
+		return nil
+	}
+	if w.confirm != nil && !w.confirm.ask(filename) {
+		w.logger.Printf("Keeping %s\n", filename)
+		return nil
+	}
+
+	if !w.deletes.take(1) {
+		w.errLogger.Printf("Keeping %s: -max-deletes reached, stopping", filename)
+		w.stopDispatch()
+		return nil
+	}
+	return w.links.remove(filename, w.logger, w.errLogger)
+}
+
+// loadBatch reads the -batch file, logging the lines that are invalid or
+// name a file that isn't selected. With abort any such line is an error.
+func loadBatch(filename string, defaults options, m *matcher, force, abort bool, errLogger *log.Logger) ([]job, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := readBatch(f, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var (
+		jobs    []job
+		invalid int
+	)
+	for _, e := range entries {
+		if e.err == nil {
+			e.err = checkInput(e.source, m, force)
+		}
+		if e.err != nil {
+			errLogger.Printf("%s:%d: %v", filename, e.line, e.err)
+			invalid++
+			continue
+		}
+		opts := e.opts
+		jobs = append(jobs, job{source: e.source, opts: &opts})
+	}
+	if abort && invalid > 0 {
+		return nil, fmt.Errorf("%s: %d invalid lines", filename, invalid)
+	}
+	return jobs, nil
+}
+
+// checkInput returns an error if the -f file isn't selected by m, unless
+// force is set.
+func checkInput(filename string, m *matcher, force bool) error {
+	info, err := os.Stat(filename)
+	if err != nil || force {
 		return err
 	}
+	if ok, reason := m.match(filename, info); !ok {
+		if reason == "" {
+			reason = fmt.Sprintf("not a %s file", strings.Join(m.exts, "/"))
+		}
+		return fmt.Errorf("skipping %s, %s (use -force-input to convert it anyway)", filename, reason)
+	}
+	return nil
+}
+
+// logWriters returns where the info and error loggers write: the info lines
+// go to the log file, syslog's info writer and the console (nil without -v),
+// and the error lines to stderr, the log file and syslog's error writer, so
+// each destination gets each line once. file, sysInfo and sysErr are nil
+// when they aren't used.
+func logWriters(file, sysInfo, sysErr, console, stderr io.Writer) (info, errs io.Writer) {
+	var infos []io.Writer
+	for _, w := range []io.Writer{file, sysInfo, console} {
+		if w != nil {
+			infos = append(infos, w)
+		}
+	}
+	switch len(infos) {
+	case 0:
+		info = ioutil.Discard
+	case 1:
+		info = infos[0]
+	default:
+		info = io.MultiWriter(infos...)
+	}
 
-	w.logger.Printf("Removing %s\n", filename)
-	return os.Remove(filename)
+	errWriters := []io.Writer{stderr}
+	for _, w := range []io.Writer{file, sysErr} {
+		if w != nil {
+			errWriters = append(errWriters, w)
+		}
+	}
+	return info, io.MultiWriter(errWriters...)
 }
 
 func main() {
 	dir := flag.String("d", "", "directory to search")
 	file := flag.String("f", "", "file to convert")
+	batchFile := flag.String("batch", "", "file listing the files to convert, one per line, each optionally followed by flags overriding the conversion options")
+	batchAbort := flag.Bool("batch-abort", false, "with -batch, convert nothing if any line is invalid")
+	concat := flag.Bool("concat", false, "merge the files of -d, in natural order, or of -batch, in the order listed, into one output named after them or given by -out")
 	recurse := flag.Bool("r", false, "search directory recursively")
+	order := flag.String("order", "path", "order files are queued in: path, or natural to sort numbers in names by value (ep2 before ep10)")
+	priority := flag.String("priority", priorityFIFO, "order queued files are converted in: fifo, size (smallest first), age (newest first) or tag (highest POST /convert priority first)")
+	orderDirs := flag.String("order-dirs", "", "with -r, convert each directory's files before (pre) or after (post) those in its subdirectories (default sorted by path)")
+	extList := flag.String("ext", ".mkv", "comma separated list of input file extensions")
+	forceInput := flag.Bool("force-input", false, "convert the -f file even if it's not selected by -ext or the other filters")
+	sampleSize := flag.Int("sample", 0, "convert only this many of the matched files, picked at random")
+	seed := flag.Int64("seed", 0, "seed picking the -sample, to pick the same files again (default random)")
+	limit := flag.Int("limit", 0, "queue at most this many files, then wait for them to finish (0 for no limit)")
+	dryRun := flag.Bool("dry-run", false, "print the ffmpeg command each file would be converted with instead of converting it")
+	estimateSpeed := flag.Float64("estimate-speed", 1, "with -dry-run, speed re-encodes are assumed to run at as a multiple of real time, e.g. 2.5")
+	estimateRatio := flag.Float64("estimate-ratio", 0.5, "with -dry-run, size of a re-encoded output assumed relative to its source")
+	manifestFile := flag.String("manifest", "", "sha256sum file of the sources; only sources matching their checksum are converted")
+	manifestOut := flag.String("manifest-out", "", "append the SHA-256 of each output to this file, in the format of -manifest")
+	maxDeletes := flag.Int("max-deletes", 0, "stop once this many sources have been removed, keeping the rest (0 for no limit; recommended for cron jobs)")
+	hardlinkPolicy := flag.String("hardlink-policy", linksConvertOnce, "what's done with sources that have other hard links: skip, convert-once (skip the other names) or delete-all (also remove the other names found in -d)")
+	var renditions renditionList
+	resume := flag.Bool("resume", false, "with -segment, -split-chapters or -rendition, keep the segments or outputs an interrupted run left and only convert the rest")
+	splitChapters := flag.Bool("split-chapters", false, "convert each chapter of a source into its own output, named e.g. \"movie - Opening.mp4\", instead of a single output")
+	flag.Var(&renditions, "rendition", "write a rendition of each source with its video scaled to this height instead of a single output, named e.g. movie_720p.mp4, optionally with a CRF: 720p:crf25 (repeatable; re-encodes with -codec or libx264)")
+	dedupe := flag.Bool("dedupe", false, "skip files in -d with the same content as one already queued")
+	scanWorkers := flag.Int("scan-workers", 1, "number of directories read concurrently with -r")
+	olderThan := flag.String("older-than", "", "only convert files last modified longer ago than this, e.g. 30d or 12h")
+	var exclude patternList
+	flag.Var(&exclude, "exclude", "skip files and directories whose name or path matches this glob pattern (repeatable)")
+	minSize := flag.String("min-size", "", "skip files smaller than this, e.g. 100M")
+	onlyResolution := flag.String("only-resolution", "", "only convert files whose video height matches, probed with ffprobe, e.g. >=2160, <=720p or 4k")
+	skipHidden := flag.Bool("skip-hidden", false, "skip files and directories whose name starts with a dot")
 	verbose := flag.Bool("v", false, "verbose")
+	workerIDs := flag.Bool("worker-ids", false, "prefix log lines with the worker's ID, e.g. [w2]")
 	workers := flag.Int("c", 1, "number of concurrent conversions")
+	autoConcurrency := flag.Bool("auto-concurrency", false, "start with one conversion and add more while that converts faster, up to -c, or as many as the CPUs with -c 1")
+	tuneInterval := flag.Duration("auto-concurrency-interval", 2*time.Minute, "with -auto-concurrency, how long the throughput is measured for before changing the number of conversions")
+	twoPhase := flag.Bool("two-phase", false, "verify every output and only remove the sources once all conversions have succeeded, keeping them all otherwise")
+	confirm := flag.Bool("confirm", false, "ask before removing each source (converts one file at a time)")
+	retries := flag.Int("retries", 0, "number of times a failed conversion is retried")
+	var retryOn kindRetries
+	flag.Var(&retryOn, "retry-on", "retries of a kind of failure, overriding -retries, e.g. network=3 (repeatable; kinds: "+kindNames()+")")
+	retryBackoff := flag.Duration("retry-backoff", 0, "delay before the first retry, doubling for each retry after (with jitter)")
+	affinity := flag.Bool("affinity", false, "pin the ffmpeg processes of each worker to their own range of CPUs (Linux only)")
+	maxLoad := flag.Float64("max-load", 0, "don't start a conversion while the 1 minute load average is at least this (Linux only, 0 for no limit)")
+	perDisk := flag.Int("per-disk", 0, "maximum concurrent conversions reading from the same disk (0 for no limit)")
+	minFree := flag.String("min-free", "", "don't start a conversion when its output's disk has less free space than this, e.g. 10G")
+	minInodes := flag.Uint64("min-free-inodes", 0, "don't start a conversion when its output's disk has fewer free inodes than this")
 	logFileLoc := flag.String("l", "", "location for file logging")
+	logMaxSize := flag.String("log-max-size", "", "rotate the -l file once it would grow past this size, e.g. 10M")
+	logMaxFiles := flag.Int("log-max-files", 5, "number of rotated -l files kept with -log-max-size")
+	useSyslog := flag.Bool("syslog", false, "also log to syslog, including the messages -v would print (not supported on Windows)")
+	syslogAddr := flag.String("syslog-addr", "", "with -syslog, the remote syslog server to log to, e.g. logs:514 or tcp://logs:514 (default the local daemon)")
+	serveAddr := flag.String("serve", "", "run an HTTP API on this address accepting conversion jobs")
+	serveRoot := flag.String("serve-root", "", "with -serve, only accept sources under this directory (default -d)")
+	pauseFile := flag.String("pause-file", "", "with -serve, hold back new conversions while this file exists")
+	listMode := flag.Bool("list", false, "print the files that would be converted, one per line, and exit")
+	listStreamsMode := flag.Bool("list-streams", false, "print the streams of each input file and exit")
+	auditMode := flag.Bool("audit", false, "report whether each input file needs converting, is converted or has a stale output, and exit")
+	planFormat := flag.String("plan-format", "text", "output format of -list-streams and -audit: text or json")
+	verifyOnly := flag.Bool("verify-only", false, "check existing outputs with ffprobe instead of converting")
+	deadline := flag.Duration("deadline", 0, "stop the whole run after this long, killing running conversions, and exit with status 3")
+	tempDir := flag.String("temp-dir", "", "write each output to this directory first, e.g. on a fast local disk, moving it to its destination once it's converted (default beside the output)")
+	tempSuffix := flag.String("temp-suffix", ".partial", "suffix of outputs while they're written (empty to write outputs in place without -temp-dir)")
+	workDir := flag.String("work-dir", "", "same as -temp-dir")
+	faststartLocal := flag.Bool("faststart-local", false, "write -faststart outputs to -temp-dir, or the system's temporary directory without it, so the pass moving their index runs on the local disk, e.g. when outputs go to NFS")
+	sinkURI := flag.String("sink", "", "upload outputs to file:///dir or s3://bucket/prefix once converted, removing the local copy (s3 reads the AWS_ environment variables)")
+	readRate := flag.String("read-rate", "", "limit how fast each source is read, in bytes per second, e.g. 5M; sources are piped to ffmpeg, which some can't be demuxed from")
+	maxOutputSize := flag.String("max-output-size", "", "stop queuing files once the outputs total this size (e.g. 500G)")
+	hookCmd := flag.String("post-hook", "", "command run after each successful conversion, before its source is removed, with the source and output as arguments and in MKV2MP4_SRC and MKV2MP4_DST")
+	hookTimeout := flag.Duration("hook-timeout", 5*time.Minute, "time after which the -post-hook is killed (0 for no limit)")
+	hookRequired := flag.Bool("hook-required", false, "fail the conversion, keeping the source, when the -post-hook fails")
+	summaryJSON := flag.String("summary-json", "", "write a JSON summary of the run to this file once it ends, even when cut short")
+	reportLoc := flag.String("report", "", "location for a CSV report of each processed file")
+	maxMem := flag.String("max-mem", "", "maximum total memory for concurrent ffmpeg processes (e.g. 4G)")
+	memPerEncode := flag.String("mem-per-encode", "", "estimated memory used by a single ffmpeg process (default estimated from -codec)")
+	var outputMap prefixMap
+	flag.Var(&outputMap, "map-output", "rewrite output paths starting with old to start with new (old=new, repeatable)")
+	proxyDir := flag.String("proxy", "", "write a smaller copy of each source of -d to the same place in this directory's tree, keeping the sources (implies -keep and -incremental, and re-encodes with -proxy-height, -proxy-crf and 128k AAC unless -codec, -acodec or -ab is given)")
+	proxyHeightFlag := flag.Int("proxy-height", proxyHeight, "with -proxy, height taller video is scaled down to (0 keeps the size)")
+	proxyCRFFlag := flag.String("proxy-crf", proxyCRF, "with -proxy, CRF the video is encoded with")
+	segment := flag.Duration("segment", 0, "split each output into segments of this length, e.g. 10m, named like movie_000.mp4")
+	idetSample := flag.Duration("idet-sample", time.Minute, "length of the start of each source checked by -deinterlace-if-needed (0 for all of it)")
+	incremental := flag.Bool("incremental", false, "skip sources whose output is newer, converting again those changed since their output was written")
+	onExisting := flag.String("on-existing", "", "what's done with outputs that already exist: skip, overwrite, rename (write \"movie (2).mp4\") or error (default error, or overwrite with -incremental)")
+	outFile := flag.String("out", "", "exact output path of the -f file, instead of the source's path with its extension swapped")
+	outSubdir := flag.String("out-subdir", "", "write each output to this directory beside its source, e.g. converted")
+	opts := defaultOptions
+	opts.registerFlags(flag.CommandLine)
+	byContainer := flag.Bool("by-container", false, "choose whether each source is copied or transcoded by its container, e.g. remuxing MKVs and transcoding AVIs (see the package docs)")
+	var containerOverrides containerModes
+	flag.Var(&containerOverrides, "container-mode", "override the -by-container mode of an extension, e.g. avi=probe (repeatable; implies -by-container; modes: copy, probe, transcode)")
+	progressJSON := flag.String("progress-json", "", "write newline delimited JSON progress events to this file, or file descriptor number such as 1 or 3")
+	wrapper := flag.String("exec-wrapper", "", "command ffmpeg is run inside, e.g. \"firejail --quiet\" or \"bwrap --ro-bind / / --dev /dev\"")
+	minFFmpeg := flag.String("min-ffmpeg", "", "refuse to start unless ffmpeg is at least this version, e.g. 6.1 (encoders of -codec and -acodec are always checked)")
+	degraded := flag.Bool("degraded", false, "when ffmpeg is older than -min-ffmpeg or is missing an encoder, warn and convert anyway instead of refusing to start")
+	writeNFO := flag.Bool("write-nfo", false, "write a sidecar describing each output next to it, for media managers such as Kodi or Jellyfin")
+	nfoFormat := flag.String("nfo-format", "nfo", "format of the -write-nfo sidecar: nfo (Kodi XML) or json")
+	rulesFile := flag.String("rules", "", "file of per-codec rules deciding how each stream is converted (an empty file uses the built-in rules)")
+	flag.BoolVar(&opts.Stdout, "stdout", false, "write the -f file's conversion to stdout as fragmented MP4, keeping the source")
+
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	completion := flag.String("completion", "", "print a completion script for bash, zsh or fish and exit")
 
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
 
-	if *dir == "" && *file == "" {
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *completion != "" {
+		if err := writeCompletion(os.Stdout, *completion, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if opts.Compat == compatList {
+		writeCompatPresets(os.Stdout)
+		return
+	}
+	inputs := 0
+	for _, in := range []string{*dir, *file, *batchFile} {
+		if in != "" {
+			inputs++
+		}
+	}
+	if inputs == 0 && *serveAddr == "" {
 		log.Fatal("no input supplied")
-	} else if *dir != "" && *file != "" {
+	} else if opts.Stdout && (*dir != "" || *batchFile != "" || *serveAddr != "") {
+		log.Fatal("-stdout can only be used with a single -f file")
+	} else if len(parseExts(*extList)) == 0 {
+		log.Fatal("no input extensions supplied")
+	} else if inputs > 1 {
 		log.Fatal("too many inputs supplied")
-	} else if *workers < 1 {
+	} else if *limit < 0 {
+		log.Fatal("-limit can't be negative")
+	} else if *order != "path" && *order != "natural" {
+		log.Fatalf("unknown -order %q (expected path or natural)", *order)
+	} else if *orderDirs != "" && *orderDirs != orderPre && *orderDirs != orderPost {
+		log.Fatalf("unknown -order-dirs %q (expected pre or post)", *orderDirs)
+	} else if *priority != priorityFIFO && *priority != prioritySize && *priority != priorityAge && *priority != priorityTag {
+		log.Fatalf("unknown -priority %q (expected fifo, size, age or tag)", *priority)
+	} else if *onExisting != "" && *onExisting != existingSkip && *onExisting != existingOverwrite && *onExisting != existingRename && *onExisting != existingError {
+		log.Fatalf("unknown -on-existing %q (expected skip, overwrite, rename or error)", *onExisting)
+	} else if *concat && (*file != "" || *serveAddr != "" || opts.Stdout || *segment > 0 || *verifyOnly || opts.TargetSize != "") {
+		log.Fatal("-concat needs -d or -batch, and can't be used with -serve, -stdout, -segment, -verify-only or -target-size")
+	} else if *outFile != "" && !*concat && (*file == "" || *serveAddr != "" || opts.Stdout || *verifyOnly) {
+		log.Fatal("-out can only be used with a single -f file")
+	} else if *segment < 0 {
+		log.Fatal("-segment must be positive")
+	} else if *segment > 0 && (opts.Stdout || *outFile != "" || *tempDir != "" || *workDir != "" || *hookCmd != "" || opts.TranscodeMissing || *verifyOnly) {
+		log.Fatal("-segment can't be used with -stdout, -out, -temp-dir, -post-hook, -transcode-missing or -verify-only")
+	} else if *serveAddr != "" && *serveRoot == "" && *dir == "" {
+		log.Fatal("-serve needs -d or -serve-root to limit the sources it accepts")
+	} else if *serveRoot != "" && *serveAddr == "" {
+		log.Fatal("-serve-root requires -serve")
+	} else if *twoPhase && *serveAddr != "" {
+		log.Fatal("-two-phase can't be used with -serve")
+	} else if *confirm && (*serveAddr != "" || opts.Stdout) {
+		log.Fatal("-confirm can't be used with -serve or -stdout")
+	} else if *workers < 1 || *confirm {
 		*workers = 1
 	}
+	if *autoConcurrency && *tuneInterval <= 0 {
+		log.Fatal("-auto-concurrency-interval must be positive")
+	} else if *autoConcurrency && *workers == 1 && !*confirm {
+		*workers = runtime.NumCPU()
+	}
+	if filepath.IsAbs(*outSubdir) {
+		log.Fatal("-out-subdir must be a relative path")
+	}
+	if *outFile != "" {
+		if info, err := os.Stat(*outFile); err == nil && info.IsDir() {
+			log.Fatalf("-out %s is a directory", *outFile)
+		}
+	}
+	if *proxyDir != "" {
+		if *dir == "" || *serveAddr != "" || opts.Stdout || opts.AudioOnly || *concat {
+			log.Fatal("-proxy needs -d and can't be used with -serve, -stdout, -audio-only or -concat")
+		}
+		if err := applyProxy(&opts, &outputMap, *dir, *proxyDir, *proxyHeightFlag, *proxyCRFFlag); err != nil {
+			log.Fatal(err)
+		}
+		*incremental = true
+	}
+	if *rulesFile != "" {
+		rules, err := loadRules(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Rules = rules
+	}
+	if err := opts.validate(); err != nil {
+		log.Fatal(err)
+	}
+	match := &matcher{exts: parseExts(*extList), exclude: exclude, skipHidden: *skipHidden}
+	if *olderThan != "" {
+		var err error
+		if match.olderThan, err = parseDuration(*olderThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *minSize != "" {
+		var err error
+		if match.minSize, err = parseSize(*minSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *onlyResolution != "" {
+		var err error
+		if match.resolution, err = parseResolutionFilter(*onlyResolution); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// setup info logger
+	// setup the loggers
 	var (
-		logOut  io.Writer
-		logFile *os.File
+		logFile io.WriteCloser
 		err     error
 	)
 	if *logFileLoc != "" {
-		logFile, err = os.OpenFile(*logFileLoc, os.O_RDWR|os.O_CREATE, os.ModeAppend)
-		if err != nil {
+		var maxSize int64
+		if *logMaxSize != "" {
+			if maxSize, err = parseSize(*logMaxSize); err != nil {
+				log.Fatal(err)
+			} else if *logMaxFiles < 0 {
+				log.Fatal("-log-max-files can't be negative")
+			}
+		}
+		if logFile, err = openLogFile(*logFileLoc, maxSize, *logMaxFiles); err != nil {
 			log.Fatal(err)
 		}
 		defer logFile.Close()
-		logOut = logFile
 	}
 
+	var sysInfo, sysErr io.Writer
+	if *useSyslog {
+		var c io.Closer
+		if sysInfo, sysErr, c, err = openSyslog(*syslogAddr); err != nil {
+			log.Fatal(err)
+		}
+		defer c.Close()
+	} else if *syslogAddr != "" {
+		log.Fatal("-syslog-addr requires -syslog")
+	}
+
+	var console io.Writer
 	if *verbose {
-		if logOut == nil {
-			logOut = os.Stdout
+		// keep stdout clean when it carries the converted file
+		console = os.Stdout
+		if opts.Stdout {
+			console = os.Stderr
+		}
+	}
+	logOut, logOutErr := logWriters(logFile, sysInfo, sysErr, console, os.Stderr)
+	logger := log.New(logOut, "", log.LstdFlags)
+	errLogger := log.New(logOutErr, "", log.LstdFlags)
+
+	if opts.AudioBitrate != "" && opts.audioCopied() {
+		errLogger.Println("Warning: -ab is ignored when audio is copied")
+		opts.AudioBitrate = ""
+	}
+
+	// cap concurrency so the estimated ffmpeg memory stays under -max-mem
+	if *maxMem != "" {
+		limit, err := parseSize(*maxMem)
+		if err != nil {
+			log.Fatal(err)
+		}
+		perEncode := encodeMemEstimate(opts.VideoCodec)
+		if *memPerEncode != "" {
+			if perEncode, err = parseSize(*memPerEncode); err != nil {
+				log.Fatal(err)
+			} else if perEncode == 0 {
+				log.Fatal("-mem-per-encode must be greater than zero")
+			}
+		}
+		*workers = memoryConcurrency(limit, perEncode, *workers)
+		logger.Printf("Running %d concurrent conversions (max memory %s, %s per encode)\n",
+			*workers, formatSize(limit), formatSize(perEncode))
+	}
+
+	if *verifyOnly {
+		match.exts = []string{opts.outputExt()}
+	}
+	queued := newInFlight()
+	scan := &scanner{match: match, recurse: *recurse, orderDirs: *orderDirs, natural: *order == "natural", limit: *limit, inFlight: queued, workers: *scanWorkers, logger: logger, errLogger: errLogger}
+	if *sampleSize > 0 {
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		scan.sample = &sampler{n: *sampleSize, seed: *seed}
+	}
+
+	if *listMode {
+		var files []string
+		if *dir != "" {
+			if files, err = scan.findFiles(*dir); err != nil {
+				errLogger.Fatal(err)
+			}
+			if *dedupe {
+				scan.dedupe = newDeduper()
+				files = scan.removeDuplicates(files)
+			}
+			if scan.sample != nil {
+				files = scan.sample.pickFiles(files)
+			}
+		} else if *file != "" {
+			if err = checkInput(*file, match, *forceInput); err != nil {
+				errLogger.Fatal(err)
+			}
+			files = []string{*file}
+		}
+		for _, f := range files {
+			fmt.Println(f)
+		}
+		return
+	}
+
+	if *auditMode {
+		if *planFormat != "text" && *planFormat != "json" {
+			errLogger.Fatalf("unknown -plan-format %q", *planFormat)
+		}
+		files := []string{*file}
+		if *dir != "" {
+			if files, err = scan.findFiles(*dir); err != nil {
+				errLogger.Fatal(err)
+			}
+		}
+		w := &worker{outputMap: outputMap, outSubdir: *outSubdir, outFile: *outFile}
+		if *segment > 0 {
+			w.segment = strconv.FormatFloat(segment.Seconds(), 'f', -1, 64)
+		}
+		if err = writeAudit(w.audit(files, opts), *planFormat, os.Stdout); err != nil {
+			errLogger.Fatal(err)
+		}
+		return
+	}
+
+	if *listStreamsMode {
+		if *planFormat != "text" && *planFormat != "json" {
+			errLogger.Fatalf("unknown -plan-format %q", *planFormat)
+		}
+		files := []string{*file}
+		if *dir != "" {
+			if files, err = scan.findFiles(*dir); err != nil {
+				errLogger.Fatal(err)
+			}
+		}
+		if err = listStreams(files, *planFormat, os.Stdout); err != nil {
+			errLogger.Fatal(err)
+		}
+		return
+	}
+
+	// check where outputs go, and the input directory when its sources are
+	// removed, before converting anything
+	srcDir := *dir
+	if srcDir == "" && *file != "" {
+		srcDir = filepath.Dir(*file)
+	}
+	var outDirs []string
+	if *outFile != "" {
+		outDirs = []string{filepath.Dir(*outFile)}
+	} else if srcDir != "" {
+		outDirs = outputMap.outputRoots(srcDir, *outSubdir)
+	}
+	if srcDir != "" && !opts.Keep && !opts.AudioOnly {
+		outDirs = append(outDirs, srcDir)
+	}
+	if info, statErr := os.Stat(srcDir); statErr == nil && info.IsDir() && !*verifyOnly && !opts.Stdout {
+		for _, d := range outDirs {
+			if err = checkWritable(existingDir(d)); err != nil {
+				errLogger.Fatal(err)
+			}
+		}
+	}
+
+	var containers containerModes
+	if *byContainer || len(containerOverrides) > 0 {
+		containers = containerOverrides.withDefaults()
+	}
+	var progress *progressStream
+	if *progressJSON != "" {
+		if progress, err = openProgressStream(*progressJSON); err != nil {
+			errLogger.Fatal(err)
+		}
+		defer progress.Close()
+	}
+	if *wrapper != "" {
+		if execWrapper, err = splitArgs(*wrapper); err != nil {
+			errLogger.Fatalf("-exec-wrapper: %v", err)
+		}
+	}
+	var degradedBy []string
+	checked := opts
+	if len(renditions) > 0 {
+		checked = renditions[0].apply(opts)
+	}
+	if !*dryRun && !*verifyOnly && (*minFFmpeg != "" || len(checked.encoders()) > 0) {
+		problems, err := checkFFmpeg(context.Background(), *minFFmpeg, checked)
+		if err != nil {
+			errLogger.Fatal(err)
+		} else if len(problems) > 0 && !*degraded {
+			errLogger.Fatalf("%s (use -degraded to convert anyway)", strings.Join(problems, "; "))
+		}
+		for _, p := range problems {
+			errLogger.Printf("Warning: %s; the run is degraded", p)
+		}
+		degradedBy = problems
+	}
+	var sidecarFormat string
+	if *writeNFO {
+		if *nfoFormat != "nfo" && *nfoFormat != "json" {
+			errLogger.Fatalf("unknown -nfo-format %q (expected nfo or json)", *nfoFormat)
+		} else if *segment > 0 {
+			errLogger.Fatal("-write-nfo can't be combined with -segment")
+		}
+		sidecarFormat = *nfoFormat
+	}
+	links, err := newLinkTracker(*hardlinkPolicy, *dir)
+	if err != nil {
+		errLogger.Fatal(err)
+	}
+	if len(renditions) > 0 && (opts.AudioOnly || opts.Stdout || opts.PreserveAll || *outFile != "" || *concat) {
+		errLogger.Fatal("-rendition can't be combined with -audio-only, -stdout, -preserve-all, -out or -concat")
+	} else if len(renditions) > 0 && opts.TargetSize != "" {
+		errLogger.Fatal("-rendition sets the quality with its CRF and can't be combined with -target-size")
+	} else if *resume && *segment == 0 && !*splitChapters && len(renditions) == 0 {
+		errLogger.Println("Warning: -resume only applies to -segment, -split-chapters and -rendition; other outputs are converted from the start")
+	} else if *splitChapters && (len(renditions) > 0 || opts.Stdout || *segment > 0 || *outFile != "" || *concat) {
+		errLogger.Fatal("-split-chapters can't be combined with -rendition, -stdout, -segment, -out or -concat")
+	}
+	if *onExisting == "" {
+		if *onExisting = existingError; *incremental {
+			*onExisting = existingOverwrite
+		}
+	}
+	var deletes *deleteCap
+	if *maxDeletes < 0 {
+		errLogger.Fatal("-max-deletes can't be negative")
+	} else if *maxDeletes > 0 {
+		deletes = &deleteCap{max: int64(*maxDeletes)}
+	}
+	var confirmRemove *confirmer
+	if *confirm && !*dryRun {
+		confirmRemove = newConfirmer(os.Stdin, os.Stderr)
+	}
+	// runCtx is done once the -deadline passes; -concat and server mode are
+	// also stopped by a signal
+	runCtx, cancelRun := context.Background(), context.CancelFunc(func() {})
+	if *deadline > 0 {
+		runCtx, cancelRun = context.WithTimeout(runCtx, *deadline)
+	}
+	defer cancelRun()
+	if *concat {
+		c := &concatJob{output: *outFile, opts: opts, onExisting: *onExisting, dryRun: *dryRun, deletes: deletes, confirm: confirmRemove, links: links, logger: logger, errLogger: errLogger}
+		if *dir != "" {
+			c.sources, err = scan.findFiles(*dir)
+			sortNatural(c.sources)
 		} else {
-			logOut = io.MultiWriter(logOut, os.Stdout)
+			var batch []job
+			batch, err = loadBatch(*batchFile, opts, match, *forceInput, true, errLogger)
+			for _, j := range batch {
+				c.sources = append(c.sources, j.source)
+			}
+		}
+		if err != nil {
+			errLogger.Fatal(err)
 		}
+		if c.output == "" && len(c.sources) > 0 {
+			c.output = concatOutput(c.sources, opts.outputExt())
+		}
+		concatCtx, stop := signal.NotifyContext(runCtx, os.Interrupt, syscall.SIGTERM)
+		err = c.run(concatCtx)
+		stop()
+		if runCtx.Err() == context.DeadlineExceeded {
+			errLogger.Printf("Merge into %s cut short by the -deadline of %s", c.output, *deadline)
+			os.Exit(exitDeadline)
+		} else if err != nil {
+			errLogger.Fatalf("Error merging into %s: %v", c.output, err)
+		}
+		return
 	}
-	if logOut == nil {
-		logOut = ioutil.Discard
+
+	var removals *removalQueue
+	if *twoPhase && !*dryRun {
+		removals = &removalQueue{}
 	}
-	logger := log.New(logOut, "", log.LstdFlags)
 
-	// setup error logger
-	var logOutErr io.Writer = os.Stderr
-	if logFile != nil {
-		logOutErr = io.MultiWriter(logOut, logFile)
+	var hook *postHook
+	if *hookCmd != "" {
+		args, err := splitArgs(*hookCmd)
+		if err != nil {
+			errLogger.Fatalf("-post-hook: %v", err)
+		}
+		hook = &postHook{args: args, timeout: *hookTimeout, required: *hookRequired}
 	}
-	errLogger := log.New(logOutErr, "", log.LstdFlags)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	var report *csvReport
+	if *reportLoc != "" {
+		if report, err = newCSVReport(*reportLoc); err != nil {
+			errLogger.Fatal(err)
+		}
+		defer report.Close()
+	}
+
+	// ctx is done when the run is aborted, in server mode also by a signal
+	ctx, cancel := context.WithCancel(runCtx)
+	if *serveAddr != "" {
+		ctx, cancel = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	}
+	defer cancel()
+
+	var (
+		jobs     *jobTracker
+		serveDir string
+	)
+	if *serveAddr != "" {
+		jobs = newJobTracker()
+		if *serveRoot == "" {
+			*serveRoot = *dir
+		}
+		if serveDir, err = sourceRoot(*serveRoot); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var disks *diskLimiter
+	if *perDisk > 0 {
+		disks = newDiskLimiter(*perDisk)
+	}
+	var freeBytes int64
+	if *minFree != "" {
+		if freeBytes, err = parseSize(*minFree); err != nil {
+			errLogger.Fatal(err)
+		}
+	}
+
+	if *workDir != "" {
+		if *tempDir != "" && *tempDir != *workDir {
+			errLogger.Fatal("-work-dir and -temp-dir can't both be used")
+		}
+		*tempDir = *workDir
+	}
+	if *tempDir != "" {
+		if info, err := os.Stat(*tempDir); err != nil {
+			errLogger.Fatal(err)
+		} else if !info.IsDir() {
+			errLogger.Fatalf("-temp-dir %s is not a directory", *tempDir)
+		} else if !*verifyOnly && !opts.Stdout {
+			if err := checkWritable(*tempDir); err != nil {
+				errLogger.Fatal(err)
+			}
+		}
+	}
+	var faststartDir string
+	if *faststartLocal {
+		if faststartDir = *tempDir; faststartDir == "" {
+			faststartDir = os.TempDir()
+		}
+	}
+	if strings.ContainsAny(*tempSuffix, `/\`) {
+		errLogger.Fatal("-temp-suffix can't contain a path separator")
+	}
+	var segmentTime string
+	if *segment > 0 {
+		segmentTime = strconv.FormatFloat(segment.Seconds(), 'f', -1, 64)
+	}
+	if *affinity && !affinitySupported {
+		errLogger.Printf("Warning: -affinity isn't supported on %s, ignoring it", runtime.GOOS)
+	}
+	var load *loadGate
+	if *maxLoad < 0 {
+		errLogger.Fatal("-max-load can't be negative")
+	} else if *maxLoad > 0 && !loadSupported {
+		errLogger.Printf("Warning: -max-load isn't supported on %s, ignoring it", runtime.GOOS)
+	} else if *maxLoad > 0 {
+		load = &loadGate{max: *maxLoad, logger: logger}
+	}
+	var sources manifest
+	if *manifestFile != "" {
+		if sources, err = loadManifest(*manifestFile); err != nil {
+			errLogger.Fatal(err)
+		}
+	}
+	var outSums *manifestWriter
+	if *manifestOut != "" && !*dryRun {
+		if outSums, err = openManifestWriter(*manifestOut); err != nil {
+			errLogger.Fatal(err)
+		}
+		defer outSums.Close()
+	}
+	var est *estimate
+	if *dryRun {
+		if *estimateSpeed <= 0 || *estimateRatio <= 0 {
+			errLogger.Fatal("-estimate-speed and -estimate-ratio must be positive")
+		}
+		est = &estimate{speed: *estimateSpeed, ratio: *estimateRatio, workers: *workers}
+	}
+	var sink Sink
+	if *sinkURI != "" {
+		if sink, err = parseSink(*sinkURI); err != nil {
+			errLogger.Fatalf("-sink: %v", err)
+		}
+	}
+	var rate int64
+	if *readRate != "" {
+		if rate, err = parseSize(*readRate); err != nil {
+			errLogger.Fatal(err)
+		} else if rate == 0 {
+			errLogger.Fatal("-read-rate must be greater than zero")
+		}
+	}
+	var quota int64
+	if *maxOutputSize != "" {
+		if quota, err = parseSize(*maxOutputSize); err != nil {
+			errLogger.Fatal(err)
+		}
+	}
+	// new files stop being queued once dispatchCtx is done
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
+	defer stopDispatch()
+	queue := newJobQueue(dispatchCtx, *priority)
+	var pause *pauser
+	if *serveAddr != "" {
+		pause = newPauser(ctx, *pauseFile, logger)
+	}
+	var tuner *concurrencyTuner
+	if *autoConcurrency {
+		tuner = newConcurrencyTuner(ctx, *workers, *tuneInterval, logger)
+	}
 	done := make(chan struct{})
-	defer func() {
-		// cancel and wait for response from all workers
-		cancel()
+	stopWorkers := func() {
+		// close the queue and wait for response from all workers
+		queue.close()
 		for i := 0; i < *workers; i++ {
 			<-done
 		}
-	}()
+	}
+	sum := newSummary()
+	for _, p := range degradedBy {
+		sum.note("degraded: " + p)
+	}
 
-	work := make(chan string)
 	for i := 0; i < *workers; i++ {
-		w := &worker{work: work, ctx: ctx, logger: logger, errLogger: errLogger, done: done}
+		w := &worker{id: i + 1, queue: queue, pause: pause, load: load, tuner: tuner, ctx: ctx, deadline: runCtx, logger: logger, errLogger: errLogger, done: done, opts: opts, report: report, jobs: jobs, outputMap: outputMap, outSubdir: *outSubdir, outFile: *outFile, incremental: *incremental, onExisting: *onExisting, segment: segmentTime, idetSample: *idetSample,
+			verifyOnly: *verifyOnly, dryRun: *dryRun, estimate: est, manifest: sources, deletes: deletes, links: links, renditions: renditions, containers: containers, progress: progress, nfoFormat: sidecarFormat, outSums: outSums, postHook: hook, confirm: confirmRemove, removals: removals, summary: sum, disks: disks, minFree: freeBytes, minInodes: *minInodes, inFlight: queued,
+			retry: retryPolicy{retries: *retries, backoff: *retryBackoff, byKind: retryOn}, quota: quota, readRate: rate, tempDir: *tempDir, tempSuffix: *tempSuffix, faststartDir: faststartDir, splitChapters: *splitChapters, resume: *resume, sink: sink, sinkRoot: *dir, stopDispatch: stopDispatch}
+		if *affinity && affinitySupported {
+			w.cpus = cpusFor(w.id, *workers, runtime.NumCPU())
+			logger.Printf("Worker %d uses CPUs %v\n", w.id, w.cpus)
+		}
+		if *workerIDs {
+			prefix := fmt.Sprintf("[w%d] ", w.id)
+			w.logger = prefixLogger(logger, prefix)
+			w.errLogger = prefixLogger(errLogger, prefix)
+		}
 		go w.listen()
 	}
 
 	if *dir != "" {
-		err = convertDirectory(*dir, *recurse, work)
-		if err != nil {
-			errLogger.Fatal(err)
+		if *dedupe {
+			scan.dedupe = newDeduper()
 		}
-	} else {
-		if !strings.HasSuffix(*file, ".mkv") {
-			err = fmt.Errorf("%s not a mkv file", *file)
-		} else {
-			work <- *file
+		err = scan.convertDirectory(*dir, queue)
+	} else if *file != "" {
+		err = scan.convertFile(*file, *forceInput, queue)
+	} else if *batchFile != "" {
+		var batch []job
+		if batch, err = loadBatch(*batchFile, opts, match, *forceInput, *batchAbort, errLogger); err == nil {
+			if scan.sample != nil {
+				batch = scan.sample.pickJobs(batch)
+			}
+			scan.dispatch(batch, queue)
 		}
 	}
+	if scan.sample != nil && scan.sample.of > 0 {
+		sum.note(scan.sample.String())
+	}
+	if scan.limit > 0 && scan.matched > scan.queued {
+		sum.note(fmt.Sprintf("limited to %d of %d matched files", scan.queued, scan.matched))
+	}
 	if err != nil {
 		errLogger.Fatal(err)
 	}
-}
 
-func convertDirectory(dirname string, recurse bool, convert chan<- string) error {
-	if info, err := os.Stat(dirname); err != nil {
-		return err
-	} else if !info.IsDir() {
-		return fmt.Errorf("%s not a directory", dirname)
+	if *serveAddr != "" {
+		if err = serve(ctx, *serveAddr, jobs, queued, opts, match, serveDir, *workers, queue, logger); err != nil {
+			errLogger.Fatal(err)
+		}
+	}
+	stopWorkers()
+	if tuner != nil {
+		if n, settled := tuner.settledOn(); settled {
+			sum.note(fmt.Sprintf("-auto-concurrency settled on %d", n))
+		} else {
+			sum.note(fmt.Sprintf("-auto-concurrency ended at %d before settling", n))
+		}
+	}
+	deadlineHit := runCtx.Err() == context.DeadlineExceeded
+	if deadlineHit {
+		sum.stop(fmt.Sprintf("deadline of %s reached", *deadline))
+	}
+	if removals != nil && removals.len() > 0 {
+		switch failed := len(sum.failures()); {
+		case deadlineHit:
+			errLogger.Printf("Keeping all %d sources since the run was cut short", removals.len())
+		case failed > 0:
+			errLogger.Printf("Keeping all %d sources since %d conversions failed", removals.len(), failed)
+		default:
+			if n := removals.removeAll(confirmRemove, deletes, links, logger, errLogger); n > 0 {
+				sum.note(fmt.Sprintf("%d sources couldn't be removed", n))
+			}
+		}
+	}
+	if deletes.hit() {
+		sum.stop(fmt.Sprintf("-max-deletes of %d reached", *maxDeletes))
+	}
+	logger.Println(sum)
+	if est != nil {
+		fmt.Println(est)
+	}
+	if *summaryJSON != "" {
+		if err := sum.writeJSON(*summaryJSON); err != nil {
+			errLogger.Printf("Error writing -summary-json: %v", err)
+		}
+	}
+	if deadlineHit {
+		errLogger.Printf("Run cut short by the -deadline of %s", *deadline)
+		os.Exit(exitDeadline)
 	}
 
-	if !strings.HasSuffix(dirname, "/") {
-		dirname += "/"
+	if *verifyOnly {
+		bad := sum.failures()
+		if len(bad) == 0 {
+			fmt.Println("All files verified")
+			return
+		}
+		fmt.Printf("%d files failed verification:\n", len(bad))
+		for _, res := range bad {
+			fmt.Printf("  %s: %v\n", res.source, res.err)
+		}
+		os.Exit(1)
 	}
+}
+
+// estimateFile adds filename's planned conversion to w.estimate. p is its
+// probe, or nil if it wasn't needed for converting.
+func (w *worker) estimateFile(filename string, p *probeResult, opts options) {
+	var size int64
+	if info, err := os.Stat(filename); err == nil {
+		size = info.Size()
+	}
+	if p == nil {
+		var err error
+		if p, err = probe(filename); err != nil {
+			w.errLogger.Printf("Warning: couldn't probe %s for the estimate: %v", filename, err)
+		}
+	}
+	var duration float64
+	if p != nil {
+		duration = p.duration()
+	}
+	if clip := opts.clipDuration(); clip > 0 && duration > 0 {
+		// a chapter is assumed to take its share of the source
+		size = int64(float64(size) * clip / duration)
+		duration = clip
+	}
+	w.estimate.add(size, duration, !opts.videoCopied())
+}
 
-	files, err := ioutil.ReadDir(dirname)
+// prefixLogger returns a copy of l that prefixes each message.
+func prefixLogger(l *log.Logger, prefix string) *log.Logger {
+	return log.New(l.Writer(), prefix, l.Flags()|log.Lmsgprefix)
+}
+
+// checkWritable verifies files can be created in dir by creating and removing
+// a temporary file.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".mkv2mp4-")
 	if err != nil {
-		return err
+		return fmt.Errorf("directory %s not writable: %v", dir, err)
 	}
+	f.Close()
+	return os.Remove(f.Name())
+}
 
-	for _, f := range files {
-		if f.IsDir() {
-			if recurse {
-				convertDirectory(dirname+f.Name(), recurse, convert)
-			}
-			continue
-		}
+// encodeMem holds rough estimates of the memory used by one ffmpeg process
+// for common video encoders.
+var encodeMem = map[string]int64{
+	"copy":       256 << 20,
+	"libx264":    1 << 30,
+	"libx265":    2 << 30,
+	"libvpx-vp9": 2 << 30,
+	"libsvtav1":  3 << 30,
+	"libaom-av1": 3 << 30,
+}
 
-		if strings.HasSuffix(f.Name(), ".mkv") {
-			convert <- dirname + f.Name()
-		}
+func encodeMemEstimate(codec string) int64 {
+	if n, ok := encodeMem[codec]; ok {
+		return n
 	}
-	return nil
+	return 1 << 30
+}
+
+// memoryConcurrency returns how many encodes of perEncode bytes fit in limit,
+// never less than one or more than max.
+func memoryConcurrency(limit, perEncode int64, max int) int {
+	n := limit / perEncode
+	if n < 1 {
+		return 1
+	} else if n > int64(max) {
+		return max
+	}
+	return int(n)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestLogWriters(t *testing.T) {
+	tests := []struct {
+		name                    string
+		file, syslog, verbose   bool
+		wantFile, wantConsole   string
+		wantStderr, wantSysInfo string
+		wantSysErr              string
+	}{
+		{name: "quiet", wantStderr: "error\n"},
+		{name: "verbose", verbose: true, wantConsole: "info\n", wantStderr: "error\n"},
+		{name: "log file", file: true, wantFile: "info\nerror\n", wantStderr: "error\n"},
+		{name: "log file and verbose", file: true, verbose: true, wantFile: "info\nerror\n", wantConsole: "info\n", wantStderr: "error\n"},
+		{name: "syslog", syslog: true, wantStderr: "error\n", wantSysInfo: "info\n", wantSysErr: "error\n"},
+		{name: "everything", file: true, syslog: true, verbose: true,
+			wantFile: "info\nerror\n", wantConsole: "info\n", wantStderr: "error\n", wantSysInfo: "info\n", wantSysErr: "error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var file, console, stderr, sysInfo, sysErr bytes.Buffer
+			var fileW, consoleW, sysInfoW, sysErrW io.Writer
+			if tt.file {
+				fileW = &file
+			}
+			if tt.verbose {
+				consoleW = &console
+			}
+			if tt.syslog {
+				sysInfoW, sysErrW = &sysInfo, &sysErr
+			}
+
+			info, errs := logWriters(fileW, sysInfoW, sysErrW, consoleW, &stderr)
+			log.New(info, "", 0).Println("info")
+			log.New(errs, "", 0).Println("error")
+
+			for _, c := range []struct {
+				name string
+				got  *bytes.Buffer
+				want string
+			}{
+				{"log file", &file, tt.wantFile},
+				{"console", &console, tt.wantConsole},
+				{"stderr", &stderr, tt.wantStderr},
+				{"syslog info", &sysInfo, tt.wantSysInfo},
+				{"syslog errors", &sysErr, tt.wantSysErr},
+			} {
+				if got := c.got.String(); got != c.want {
+					t.Errorf("%s got %q, want %q", c.name, got, c.want)
+				}
+			}
+		})
+	}
+}
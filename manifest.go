@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A manifest lists the SHA-256 of files in the format of sha256sum, one file
+// per line:
+//
+//	<hex digest>  <path>
+//
+// Relative paths are relative to the directory of the manifest.
+type manifest map[string]string // digests by absolute path
+
+func loadManifest(path string) (manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	m := make(manifest)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a digest and a path", path, n)
+		}
+		sum, file := strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+		// sha256sum marks files read in binary mode with a *
+		file = strings.TrimPrefix(file, "*")
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-256 %q", path, n, sum)
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		m[filepath.Clean(file)] = sum
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// verify returns an error wrapping ErrChecksum unless filename is listed
+// with the digest of its content.
+func (m manifest) verify(filename string) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	want, ok := m[abs]
+	if !ok {
+		return fmt.Errorf("%w: not listed", ErrChecksum)
+	}
+	got, err := sha256File(filename)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: got %s, expected %s (possibly corrupt)", ErrChecksum, got, want)
+	}
+	return nil
+}
+
+// sha256File returns the hex SHA-256 of the file's content, reading it in
+// chunks rather than all at once.
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestWriter appends the digests of outputs to a manifest. It's safe
+// for concurrent use.
+type manifestWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openManifestWriter(path string) (*manifestWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestWriter{f: f}, nil
+}
+
+// add appends the digest of filename under its absolute path.
+func (mw *manifestWriter) add(filename string) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	sum, err := sha256File(filename)
+	if err != nil {
+		return err
+	}
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	_, err = fmt.Fprintf(mw.f, "%s  %s\n", sum, abs)
+	return err
+}
+
+func (mw *manifestWriter) Close() error {
+	return mw.f.Close()
+}
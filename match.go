@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// matcher decides which files are picked up for conversion.
+type matcher struct {
+	exts       []string
+	exclude    patternList
+	minSize    int64
+	olderThan  time.Duration
+	skipHidden bool
+	resolution *resolutionFilter // probed last, being the slowest
+}
+
+// match reports whether the file at path is selected. When it isn't, reason
+// says why, or is empty for files that just don't have an input extension.
+func (m *matcher) match(path string, info os.FileInfo) (ok bool, reason string) {
+	if !hasExt(info.Name(), m.exts) {
+		return false, ""
+	}
+	if m.skipHidden && isHidden(info.Name()) {
+		return false, "hidden"
+	}
+	if p := m.exclude.match(path); p != "" {
+		return false, fmt.Sprintf("excluded by %s", p)
+	}
+	if info.Size() < m.minSize {
+		return false, fmt.Sprintf("smaller than %s", formatSize(m.minSize))
+	}
+	if m.olderThan > 0 && time.Since(info.ModTime()) < m.olderThan {
+		return false, fmt.Sprintf("modified less than %s ago", m.olderThan)
+	}
+	if m.resolution != nil {
+		return m.resolution.matchResolution(path)
+	}
+	return true, ""
+}
+
+// matchDir reports whether the directory at path should be searched.
+func (m *matcher) matchDir(path string) bool {
+	if m.skipHidden && isHidden(filepath.Base(path)) {
+		return false
+	}
+	return m.exclude.match(path) == ""
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// patternList is a repeatable flag of shell glob patterns.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(p string) error {
+	if _, err := filepath.Match(p, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", p)
+	}
+	*l = append(*l, p)
+	return nil
+}
+
+// match returns the first pattern matching the base name of path or path
+// itself, or "" if none do.
+func (l patternList) match(path string) string {
+	for _, p := range l {
+		if ok, _ := filepath.Match(p, filepath.Base(path)); ok {
+			return p
+		}
+		if ok, _ := filepath.Match(p, path); ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// hasExt reports whether name ends with one of exts, ignoring case, so
+// Movie.MKV has the extension .mkv.
+func hasExt(name string, exts []string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range exts {
+		if strings.HasSuffix(name, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExts parses a comma separated list of extensions, adding the leading
+// dot where it's missing.
+func parseExts(s string) []string {
+	var exts []string
+	for _, ext := range strings.Split(s, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			exts = append(exts, "."+strings.TrimPrefix(ext, "."))
+		}
+	}
+	return exts
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeInfo is the os.FileInfo of a regular file that doesn't exist.
+type fakeInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeInfo) ModTime() time.Time { return f.modTime }
+func (f fakeInfo) IsDir() bool        { return false }
+func (f fakeInfo) Sys() interface{}   { return nil }
+
+func TestMatcherMatch(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	tests := []struct {
+		name   string
+		m      matcher
+		path   string
+		info   fakeInfo
+		ok     bool
+		reason string
+	}{
+		{"selected", matcher{exts: []string{".mkv"}},
+			"dir/movie.mkv", fakeInfo{"movie.mkv", 100, old}, true, ""},
+		{"other extension", matcher{exts: []string{".mkv"}},
+			"dir/movie.mp4", fakeInfo{"movie.mp4", 100, old}, false, ""},
+		{"excluded by name", matcher{exts: []string{".mkv"}, exclude: patternList{"*sample*"}},
+			"dir/movie-sample.mkv", fakeInfo{"movie-sample.mkv", 100, old}, false, "excluded by *sample*"},
+		{"excluded by path", matcher{exts: []string{".mkv"}, exclude: patternList{"extras/*"}},
+			"extras/movie.mkv", fakeInfo{"movie.mkv", 100, old}, false, "excluded by extras/*"},
+		{"not excluded", matcher{exts: []string{".mkv"}, exclude: patternList{"*sample*"}},
+			"dir/movie.mkv", fakeInfo{"movie.mkv", 100, old}, true, ""},
+		{"too small", matcher{exts: []string{".mkv"}, minSize: 1 << 20},
+			"dir/movie.mkv", fakeInfo{"movie.mkv", 1<<20 - 1, old}, false, "smaller than " + formatSize(1<<20)},
+		{"at the minimum size", matcher{exts: []string{".mkv"}, minSize: 1 << 20},
+			"dir/movie.mkv", fakeInfo{"movie.mkv", 1 << 20, old}, true, ""},
+		{"too new", matcher{exts: []string{".mkv"}, olderThan: 72 * time.Hour},
+			"dir/movie.mkv", fakeInfo{"movie.mkv", 100, old}, false, "modified less than 72h0m0s ago"},
+		{"old enough", matcher{exts: []string{".mkv"}, olderThan: 24 * time.Hour},
+			"dir/movie.mkv", fakeInfo{"movie.mkv", 100, old}, true, ""},
+		{"hidden", matcher{exts: []string{".mkv"}, skipHidden: true},
+			"dir/.movie.mkv", fakeInfo{".movie.mkv", 100, old}, false, "hidden"},
+		{"hidden kept", matcher{exts: []string{".mkv"}},
+			"dir/.movie.mkv", fakeInfo{".movie.mkv", 100, old}, true, ""},
+	}
+	for _, tt := range tests {
+		ok, reason := tt.m.match(tt.path, tt.info)
+		if ok != tt.ok || reason != tt.reason {
+			t.Errorf("%s: match(%q) = %v, %q, want %v, %q", tt.name, tt.path, ok, reason, tt.ok, tt.reason)
+		}
+	}
+}
+
+func TestMatcherMatchDir(t *testing.T) {
+	tests := []struct {
+		m    matcher
+		path string
+		want bool
+	}{
+		{matcher{}, "dir/.hidden", true},
+		{matcher{skipHidden: true}, "dir/.hidden", false},
+		{matcher{skipHidden: true}, "dir/shown", true},
+		{matcher{exclude: patternList{"extras"}}, "dir/extras", false},
+		{matcher{exclude: patternList{"extras"}}, "dir/movies", true},
+	}
+	for _, tt := range tests {
+		if got := tt.m.matchDir(tt.path); got != tt.want {
+			t.Errorf("matchDir(%q) with %+v = %v, want %v", tt.path, tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestHasExt(t *testing.T) {
+	tests := []struct {
+		name string
+		exts []string
+		want bool
+	}{
+		{"movie.mkv", []string{".mkv"}, true},
+		{"Movie.MKV", []string{".mkv"}, true},
+		{"Movie.Mkv", []string{".mkv"}, true},
+		{"movie.mkv", []string{".MKV"}, true},
+		{"movie.avi", []string{".mkv", ".avi"}, true},
+		{"movie.mp4", []string{".mkv"}, false},
+		{"movie.mkv.part", []string{".mkv"}, false},
+		{"mkv", []string{".mkv"}, false},
+		{"movie.mkv", nil, false},
+	}
+	for _, tt := range tests {
+		if got := hasExt(tt.name, tt.exts); got != tt.want {
+			t.Errorf("hasExt(%q, %q) = %v, want %v", tt.name, tt.exts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// rename moves a file within a file system, failing across them. Tests
+// replace it to move across file systems without having two.
+var rename = os.Rename
+
+// moveFile moves src to dst, copying it when they're on different file
+// systems. The copy is written next to dst with src's permissions and
+// renamed into place, so dst never holds a partial file.
+func moveFile(src, dst string) error {
+	if err := rename(src, dst); err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	part := dst + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(part)
+		return err
+	}
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		out.Close()
+		os.Remove(part)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Remove(src)
+}
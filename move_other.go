@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// notSameDevice is Windows' ERROR_NOT_SAME_DEVICE, returned by a rename
+// across volumes.
+const notSameDevice = syscall.Errno(17)
+
+// isCrossDevice reports whether err is a rename failing because the paths
+// are on different volumes.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, notSameDevice)
+}
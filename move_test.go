@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// crossDevice makes rename fail like it does across file systems for the
+// rest of t.
+func crossDevice(t *testing.T) {
+	t.Helper()
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { rename = os.Rename })
+}
+
+func TestMoveFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		crossDevice bool
+	}{
+		{"same file system", false},
+		{"across file systems", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.crossDevice {
+				crossDevice(t)
+			}
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "tmp", "1-movie.mp4"), filepath.Join(dir, "movie.mp4")
+			if err := os.Mkdir(filepath.Dir(src), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(src, []byte("converted"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := moveFile(src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadFile(dst); err != nil {
+				t.Fatal(err)
+			} else if string(got) != "converted" {
+				t.Errorf("%s holds %q, want %q", dst, got, "converted")
+			}
+			for _, gone := range []string{src, dst + ".part"} {
+				if _, err := os.Lstat(gone); !os.IsNotExist(err) {
+					t.Errorf("%s is left behind (%v)", gone, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveFileCopyFails(t *testing.T) {
+	crossDevice(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "movie.mp4")
+	if err := ioutil.WriteFile(src, []byte("converted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "missing", "movie.mp4")
+
+	if err := moveFile(src, dst); err == nil {
+		t.Fatal("moveFile into a missing directory succeeded")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("the source is gone after a failed move: %v", err)
+	}
+}
+
+func TestMoveFileOtherRenameError(t *testing.T) {
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+	}
+	defer func() { rename = os.Rename }()
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "tmp-movie.mp4"), filepath.Join(dir, "movie.mp4")
+	if err := ioutil.WriteFile(src, []byte("converted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveFile(src, dst); !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("moveFile = %v, want the rename's error", err)
+	}
+	for _, gone := range []string{dst, dst + ".part"} {
+		if _, err := os.Lstat(gone); !os.IsNotExist(err) {
+			t.Errorf("%s was copied when the rename failed for another reason (%v)", gone, err)
+		}
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("the source is gone after a failed move: %v", err)
+	}
+}
+
+func TestMoveFileKeepsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't keep Unix permissions")
+	}
+	crossDevice(t)
+	for _, mode := range []os.FileMode{0600, 0755} {
+		dir := t.TempDir()
+		src, dst := filepath.Join(dir, "tmp-movie.mp4"), filepath.Join(dir, "movie.mp4")
+		if err := ioutil.WriteFile(src, []byte("converted"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(src, mode); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := moveFile(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(dst); err != nil {
+			t.Fatal(err)
+		} else if got := info.Mode().Perm(); got != mode {
+			t.Errorf("copied a %v file as %v", mode, got)
+		}
+	}
+}
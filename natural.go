@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// sortNatural sorts names so that runs of digits compare by their value,
+// e.g. part2 before part10.
+func sortNatural(names []string) {
+	sort.SliceStable(names, func(i, j int) bool {
+		return naturalLess(names[i], names[j])
+	})
+}
+
+// naturalLess compares a and b with runs of digits compared by their value.
+// Of numbers of equal value the one with more leading zeros comes first,
+// e.g. 01 before 1 and 000 before 0, so the order is total.
+func naturalLess(a, b string) bool {
+	tie := 0
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			} else if na != nb {
+				return na < nb
+			} else if tie == 0 {
+				tie = len(db) - len(da)
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return tie < 0
+}
+
+// digitPrefix returns the digits s starts with.
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
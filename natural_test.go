@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"ep2", "ep10", true},
+		{"ep10", "ep2", false},
+		{"ep2", "ep2", false},
+		{"ep02", "ep10", true},
+		{"ep010", "ep9", false},
+		// equal values compare by their text, leading zeros first
+		{"ep01", "ep1", true},
+		{"ep1", "ep01", false},
+		{"ep001", "ep01", true},
+		// a later difference outweighs leading zeros
+		{"ep01b", "ep1a", false},
+		{"ep1a", "ep01b", true},
+		// mixed segments
+		{"s1e10", "s1e9", false},
+		{"s1e9", "s2e1", true},
+		{"s10e1", "s2e1", false},
+		{"show 2 part 10", "show 2 part 3", false},
+		{"v1.10.2", "v1.9.12", false},
+		// digits against letters compare by character
+		{"1a", "a1", true},
+		{"a", "1", false},
+		// prefixes first
+		{"ep1", "ep1a", true},
+		{"ep", "ep1", true},
+		{"", "a", true},
+		{"a", "", false},
+		// numbers longer than an int64
+		{"x99999999999999999999", "x100000000000000000000", true},
+		{"x000", "x0", true},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSortNatural(t *testing.T) {
+	want := []string{"ep00", "ep0", "ep1", "ep01a", "ep1b", "ep2", "ep09", "ep9", "ep10", "ep10.5", "ep10a", "ep100", "special"}
+	names := []string{"ep1b", "special", "ep100", "ep10a", "ep9", "ep00", "ep01a", "ep10", "ep2", "ep0", "ep10.5", "ep09", "ep1"}
+	sortNatural(names)
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("sortNatural = %q, want %q", names, want)
+	}
+
+	// the order is total: exactly one of each pair of distinct names sorts
+	// first
+	for i, a := range want {
+		for j, b := range want {
+			if i < j && (!naturalLess(a, b) || naturalLess(b, a)) {
+				t.Errorf("%q and %q aren't ordered", a, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// nfoMovie is the sidecar written with -write-nfo, either as a Kodi style
+// movie NFO or as JSON.
+type nfoMovie struct {
+	XMLName   xml.Name      `xml:"movie" json:"-"`
+	Title     string        `xml:"title" json:"title"`
+	Runtime   int           `xml:"runtime" json:"runtime_minutes"`
+	Duration  float64       `xml:"-" json:"duration_seconds"`
+	Video     []nfoVideo    `xml:"fileinfo>streamdetails>video" json:"video"`
+	Audio     []nfoAudio    `xml:"fileinfo>streamdetails>audio" json:"audio"`
+	Subtitles []nfoSubtitle `xml:"fileinfo>streamdetails>subtitle" json:"subtitles,omitempty"`
+}
+
+type nfoVideo struct {
+	Codec    string `xml:"codec" json:"codec"`
+	Width    int    `xml:"width" json:"width"`
+	Height   int    `xml:"height" json:"height"`
+	Duration int    `xml:"durationinseconds" json:"-"`
+}
+
+type nfoAudio struct {
+	Codec    string `xml:"codec" json:"codec"`
+	Language string `xml:"language,omitempty" json:"language,omitempty"`
+}
+
+type nfoSubtitle struct {
+	Language string `xml:"language" json:"language"`
+}
+
+// newNFO describes the output at path from its probe p. The title is the
+// output's title tag, or its name without the extension.
+func newNFO(path string, p *probeResult) nfoMovie {
+	title := p.Format.Tags["title"]
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	d := p.duration()
+	m := nfoMovie{Title: title, Runtime: int(math.Round(d / 60)), Duration: d}
+	for _, st := range p.Streams {
+		switch {
+		case isCover(st):
+		case st.CodecType == "video":
+			m.Video = append(m.Video, nfoVideo{Codec: st.CodecName, Width: st.Width, Height: st.Height, Duration: int(math.Round(d))})
+		case st.CodecType == "audio":
+			m.Audio = append(m.Audio, nfoAudio{Codec: st.CodecName, Language: st.Tags["language"]})
+		case st.CodecType == "subtitle":
+			m.Subtitles = append(m.Subtitles, nfoSubtitle{Language: st.Tags["language"]})
+		}
+	}
+	return m
+}
+
+// writeNFO probes output and writes its sidecar in format, nfo or json,
+// next to it, returning the sidecar's path.
+func writeNFO(output, format string) (string, error) {
+	p, err := probe(output)
+	if err != nil {
+		return "", err
+	}
+	m := newNFO(output, p)
+	var data []byte
+	if format == "json" {
+		data, err = json.MarshalIndent(m, "", "  ")
+	} else {
+		data, err = xml.MarshalIndent(m, "", "  ")
+		data = append([]byte(xml.Header), data...)
+	}
+	if err != nil {
+		return "", err
+	}
+	path := strings.TrimSuffix(output, filepath.Ext(output)) + "." + format
+	return path, ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
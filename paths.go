@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputName swaps the extension of filename for ext.
+func outputName(filename, ext string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+}
+
+// matchCase returns ext in upper case when the extension of filename is.
+func matchCase(filename, ext string) string {
+	old := filepath.Ext(filename)
+	if old != strings.ToLower(old) && old == strings.ToUpper(old) {
+		return strings.ToUpper(ext)
+	}
+	return ext
+}
+
+// muxers are the ffmpeg formats of output extensions, given to ffmpeg when
+// it can't tell the format from a temporary output's name.
+var muxers = map[string]string{
+	".mp4":  "mp4",
+	".m4v":  "ipod",
+	".m4a":  "ipod",
+	".mov":  "mov",
+	".aac":  "adts",
+	".mka":  "matroska",
+	".mp3":  "mp3",
+	".flac": "flac",
+	".opus": "opus",
+	".ogg":  "ogg",
+	".wav":  "wav",
+}
+
+// tempPath returns where out is written with opts until it's done, and the
+// format ffmpeg needs to be told to write it in. In a temporary directory
+// the name starts with the worker's ID, so outputs of the same name don't
+// collide.
+func (w *worker) tempPath(out string, opts options) (path, format string) {
+	dir, name := filepath.Split(out)
+	if d := w.tempDirFor(opts); d != "" {
+		dir, name = d, fmt.Sprintf("%d-%s", w.id, name)
+	}
+	if w.tempSuffix == "" {
+		return filepath.Join(dir, name), ""
+	}
+	if f, ok := muxers[strings.ToLower(filepath.Ext(out))]; ok {
+		return filepath.Join(dir, name+w.tempSuffix), f
+	}
+	// keep the extension last for ffmpeg to tell the format from
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, strings.TrimSuffix(name, ext)+w.tempSuffix+ext), ""
+}
+
+// tempDirFor returns the directory outputs converted with opts are written
+// in until they're done, or "" for beside them. With -faststart-local the
+// outputs of -faststart go to a local directory, so the second pass that
+// moves their index runs on the local disk instead of the destination's.
+func (w *worker) tempDirFor(opts options) string {
+	if opts.Faststart && w.faststartDir != "" {
+		return w.faststartDir
+	}
+	return w.tempDir
+}
+
+type prefixMapping struct {
+	old, new string
+}
+
+// prefixMap is a repeatable old=new flag rewriting the prefix of output paths.
+type prefixMap []prefixMapping
+
+func (m *prefixMap) String() string {
+	if m == nil {
+		return ""
+	}
+	s := make([]string, len(*m))
+	for i, p := range *m {
+		s[i] = p.old + "=" + p.new
+	}
+	return strings.Join(s, ",")
+}
+
+func (m *prefixMap) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid mapping %q (expected old=new)", v)
+	}
+
+	old, err := filepath.Abs(parts[0])
+	if err != nil {
+		return err
+	}
+	new, err := filepath.Abs(parts[1])
+	if err != nil {
+		return err
+	}
+	if old == new {
+		return fmt.Errorf("mapping %q doesn't change the path", v)
+	}
+	*m = append(*m, prefixMapping{old: old, new: new})
+	return nil
+}
+
+// apply rewrites path using the longest matching prefix. Prefixes only match
+// whole path elements, so /old doesn't match /older.
+func (m prefixMap) apply(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path, false
+	}
+
+	best := -1
+	for i, p := range m {
+		if abs != p.old && !strings.HasPrefix(abs, p.old+string(filepath.Separator)) {
+			continue
+		}
+		if best == -1 || len(p.old) > len(m[best].old) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return path, false
+	}
+	return m[best].new + strings.TrimPrefix(abs, m[best].old), true
+}
+
+// outputRoots returns the directories outputs of sources under dir end up
+// in with the -out-subdir subdir and the -map-output mappings of m, and
+// those of mappings for directories below dir.
+func (m prefixMap) outputRoots(dir, subdir string) []string {
+	root := dir
+	if subdir != "" {
+		root = filepath.Join(root, subdir)
+	}
+	if mapped, ok := m.apply(root); ok {
+		root = mapped
+	}
+	roots := []string{root}
+	if abs, err := filepath.Abs(dir); err == nil {
+		for _, p := range m {
+			if strings.HasPrefix(p.old, abs+string(filepath.Separator)) {
+				roots = append(roots, p.new)
+			}
+		}
+	}
+	return roots
+}
+
+// existingDir returns dir, or its closest parent that exists when dir has yet
+// to be created.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
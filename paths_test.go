@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestMatchCase(t *testing.T) {
+	tests := []struct {
+		filename, ext, want string
+	}{
+		{"movie.mkv", ".mp4", ".mp4"},
+		{"Movie.MKV", ".mp4", ".MP4"},
+		{"Movie.Mkv", ".mp4", ".mp4"},
+		{"MOVIE.mkv", ".mp4", ".mp4"},
+		{"dir/Movie.AVI", ".m4v", ".M4V"},
+		{"movie", ".mp4", ".mp4"},
+		// no letters to tell the case by
+		{"movie.264", ".mp4", ".mp4"},
+	}
+	for _, tt := range tests {
+		if got := matchCase(tt.filename, tt.ext); got != tt.want {
+			t.Errorf("matchCase(%q, %q) = %q, want %q", tt.filename, tt.ext, got, tt.want)
+		}
+	}
+}
+
+func TestOutputPathMatchCase(t *testing.T) {
+	tests := []struct {
+		filename  string
+		matchCase bool
+		want      string
+	}{
+		{"Movie.MKV", false, "Movie.mp4"},
+		{"Movie.MKV", true, "Movie.MP4"},
+		{"movie.mkv", true, "movie.mp4"},
+		{"Movie.Mkv", true, "Movie.mp4"},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.MatchCase = tt.matchCase
+		w := &worker{}
+		if got := w.outputPath(tt.filename, opts); got != tt.want {
+			t.Errorf("outputPath(%q) with -match-case=%v = %q, want %q", tt.filename, tt.matchCase, got, tt.want)
+		}
+	}
+}
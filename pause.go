@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// pauser gates the dispatch of new jobs. Dispatch is paused while toggled on
+// by signal or while the pause file exists. In-flight conversions continue.
+type pauser struct {
+	mu      sync.Mutex
+	toggled bool
+	file    string
+	logger  *log.Logger
+	paused  bool
+}
+
+func newPauser(ctx context.Context, file string, logger *log.Logger) *pauser {
+	p := &pauser{file: file, logger: logger}
+	sig := make(chan os.Signal, 1)
+	notifyPause(sig)
+	go func() {
+		for {
+			select {
+			case <-sig:
+				p.mu.Lock()
+				p.toggled = !p.toggled
+				p.mu.Unlock()
+				p.check()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// check reports whether dispatch is paused, logging any change.
+func (p *pauser) check() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	paused := p.toggled
+	if !paused && p.file != "" {
+		_, err := os.Stat(p.file)
+		paused = err == nil
+	}
+
+	if paused != p.paused {
+		if paused {
+			p.logger.Println("Paused, no new conversions will start")
+		} else {
+			p.logger.Println("Resumed")
+		}
+		p.paused = paused
+	}
+	return paused
+}
+
+// wait blocks while dispatch is paused. It returns false if ctx is done first.
+func (p *pauser) wait(ctx context.Context) bool {
+	for p.check() {
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyPause is a no-op where SIGUSR2 isn't available; use -pause-file.
+func notifyPause(c chan<- os.Signal) {}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyPause(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
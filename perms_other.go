@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// copyOwner is a no-op where files don't have a uid and gid.
+func copyOwner(info os.FileInfo, dst string) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner gives dst the same uid and gid as the file described by info.
+// This usually requires root.
+func copyOwner(info os.FileInfo, dst string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Chown(dst, int(st.Uid), int(st.Gid))
+}
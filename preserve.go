@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// preserveArgs returns the stream arguments of -preserve-all, copying every
+// stream of p with its metadata and dispositions. The chapters are mapped
+// along with the other options.
+func preserveArgs(p *probeResult) []string {
+	args := []string{"-map", "0", "-codec", "copy", "-map_metadata", "0"}
+	for i, st := range p.Streams {
+		// ffmpeg otherwise picks its own default streams
+		args = append(args, "-disposition:"+strconv.Itoa(i), disposition(st))
+	}
+	return args
+}
+
+// disposition returns the flags set in st's disposition as a value of
+// ffmpeg's -disposition, e.g. default+forced, or 0 if none are.
+func disposition(st probeStream) string {
+	var flags []string
+	for name, set := range st.Disposition {
+		if set == 1 {
+			flags = append(flags, name)
+		}
+	}
+	if len(flags) == 0 {
+		return "0"
+	}
+	sort.Strings(flags)
+	return strings.Join(flags, "+")
+}
+
+// uncopyable returns an error wrapping ErrIncompatibleCodec naming the
+// streams of p that can't be copied into an MP4, which -preserve-all would
+// otherwise lose.
+func uncopyable(p *probeResult) error {
+	var streams []string
+	for _, st := range p.Streams {
+		if defaultRules.match(st).action != ruleCopy {
+			streams = append(streams, fmt.Sprintf("%d (%s %s)", st.Index, st.CodecType, st.CodecName))
+		}
+	}
+	if len(streams) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: -preserve-all can't copy stream %s", ErrIncompatibleCodec, strings.Join(streams, ", "))
+}
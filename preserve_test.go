@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFFmpegArgsPreserveAll(t *testing.T) {
+	p := &probeResult{Streams: []probeStream{
+		{Index: 0, CodecType: "video", CodecName: "h264", Disposition: map[string]int{"default": 1}},
+		{Index: 1, CodecType: "audio", CodecName: "aac", Disposition: map[string]int{"default": 1, "forced": 0}},
+		{Index: 2, CodecType: "subtitle", CodecName: "mov_text", Disposition: map[string]int{"forced": 1, "default": 1}},
+		{Index: 3, CodecType: "subtitle", CodecName: "mov_text"},
+	}}
+	opts := defaultOptions
+	opts.PreserveAll = true
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+	got := ffmpegArgs(opts, p, "in.mkv", "out.mp4")
+	want := []string{
+		"-loglevel", "error", "-i", "in.mkv",
+		"-map", "0", "-codec", "copy", "-map_metadata", "0",
+		"-disposition:0", "default", "-disposition:1", "default", "-disposition:2", "default+forced", "-disposition:3", "0",
+		"-map_chapters", "0", "out.mp4",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ffmpegArgs = %q, want %q", got, want)
+	}
+}
+
+func TestDisposition(t *testing.T) {
+	tests := []struct {
+		disposition map[string]int
+		want        string
+	}{
+		{nil, "0"},
+		{map[string]int{"default": 0, "forced": 0}, "0"},
+		{map[string]int{"default": 1}, "default"},
+		{map[string]int{"hearing_impaired": 1, "forced": 1, "default": 0}, "forced+hearing_impaired"},
+	}
+	for _, tt := range tests {
+		if got := disposition(probeStream{Disposition: tt.disposition}); got != tt.want {
+			t.Errorf("disposition(%v) = %q, want %q", tt.disposition, got, tt.want)
+		}
+	}
+}
+
+func TestUncopyable(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams []probeStream
+		want    string // the error, "" for none
+	}{
+		{"copyable", []probeStream{
+			{Index: 0, CodecType: "video", CodecName: "hevc"},
+			{Index: 1, CodecType: "audio", CodecName: "eac3"},
+			{Index: 2, CodecType: "subtitle", CodecName: "mov_text"},
+		}, ""},
+		{"uncopyable", []probeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "dts"},
+			{Index: 2, CodecType: "subtitle", CodecName: "subrip"},
+			{Index: 3, CodecType: "attachment", CodecName: "ttf"},
+		}, "codec not supported by the output container: -preserve-all can't copy stream 1 (audio dts), 2 (subtitle subrip), 3 (attachment ttf)"},
+	}
+	for _, tt := range tests {
+		err := uncopyable(&probeResult{Streams: tt.streams})
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: uncopyable = %v, want none", tt.name, err)
+		case tt.want != "" && (err == nil || err.Error() != tt.want):
+			t.Errorf("%s: uncopyable = %v, want %s", tt.name, err, tt.want)
+		case err != nil && !errors.Is(err, ErrIncompatibleCodec):
+			t.Errorf("%s: uncopyable = %v, want it to wrap ErrIncompatibleCodec", tt.name, err)
+		}
+	}
+}
+
+func TestValidatePreserveAll(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(*options)
+		ok   bool
+	}{
+		{"alone", func(o *options) {}, true},
+		{"with -codec", func(o *options) { o.VideoCodec = "libx264" }, false},
+		{"with -acodec", func(o *options) { o.AudioCodec = "aac" }, false},
+		{"with -audio-only", func(o *options) { o.AudioOnly = true }, false},
+		{"with -keep-langs", func(o *options) { o.KeepLangs = "eng" }, false},
+		{"without chapters", func(o *options) { o.Chapters = false }, false},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.PreserveAll = true
+		tt.opts(&opts)
+		if err := opts.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
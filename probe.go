@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeResult is the subset of ffprobe's JSON output used here.
+type probeResult struct {
+	Format   probeFormat    `json:"format"`
+	Streams  []probeStream  `json:"streams"`
+	Chapters []probeChapter `json:"chapters"`
+}
+
+type probeFormat struct {
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"`
+	Size       string            `json:"size"`
+	BitRate    string            `json:"bit_rate"`
+	Tags       map[string]string `json:"tags"`
+}
+
+type probeStream struct {
+	Index       int               `json:"index"`
+	CodecType   string            `json:"codec_type"`
+	CodecName   string            `json:"codec_name"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	BitRate     string            `json:"bit_rate"`
+	Disposition map[string]int    `json:"disposition"`
+	Tags        map[string]string `json:"tags"`
+
+	ColorPrimaries string          `json:"color_primaries"`
+	ColorTransfer  string          `json:"color_transfer"`
+	ColorSpace     string          `json:"color_space"`
+	SideData       []probeSideData `json:"side_data_list"`
+}
+
+// probeSideData is a stream's side data, of which only HDR metadata is used.
+// Chromaticities and luminances are rationals such as "34000/50000".
+type probeSideData struct {
+	Type string `json:"side_data_type"`
+
+	RedX         string `json:"red_x"`
+	RedY         string `json:"red_y"`
+	GreenX       string `json:"green_x"`
+	GreenY       string `json:"green_y"`
+	BlueX        string `json:"blue_x"`
+	BlueY        string `json:"blue_y"`
+	WhitePointX  string `json:"white_point_x"`
+	WhitePointY  string `json:"white_point_y"`
+	MinLuminance string `json:"min_luminance"`
+	MaxLuminance string `json:"max_luminance"`
+
+	MaxContent int `json:"max_content"`
+	MaxAverage int `json:"max_average"`
+}
+
+type probeChapter struct {
+	ID        int64             `json:"id"`
+	StartTime string            `json:"start_time"`
+	EndTime   string            `json:"end_time"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// probeCacheSize bounds the number of results kept by the probe cache.
+const probeCacheSize = 1024
+
+// probeKey identifies a version of a file, so a cached result is dropped
+// once the file changes.
+type probeKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// probeCache holds ffprobe results so a file probed more than once in a run
+// is only read by ffprobe once. When full the oldest result is evicted. It's
+// safe for concurrent use.
+type probeCache struct {
+	mu      sync.Mutex
+	results map[probeKey]*probeResult
+	order   []probeKey
+}
+
+var probes = &probeCache{results: make(map[probeKey]*probeResult)}
+
+func (c *probeCache) get(k probeKey) (*probeResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.results[k]
+	return p, ok
+}
+
+func (c *probeCache) put(k probeKey, p *probeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.results[k]; ok {
+		return
+	}
+	if len(c.order) >= probeCacheSize {
+		delete(c.results, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.results[k] = p
+	c.order = append(c.order, k)
+}
+
+// probe runs ffprobe on filename, reusing the result of an earlier probe if
+// the file hasn't changed since. The result must not be modified.
+func probe(filename string) (*probeResult, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	k := probeKey{path: filename, size: info.Size(), modTime: info.ModTime()}
+	if p, ok := probes.get(k); ok {
+		return p, nil
+	}
+
+	p, err := runProbe(filename)
+	if err != nil {
+		return nil, err
+	}
+	probes.put(k, p)
+	return p, nil
+}
+
+func runProbe(filename string) (*probeResult, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", "-show_chapters", filename)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ffprobe: %s", msg)
+		}
+		return nil, err
+	}
+
+	var p probeResult
+	if err := json.Unmarshal(stdout.Bytes(), &p); err != nil {
+		return nil, fmt.Errorf("parsing ffprobe output: %v", err)
+	}
+	return &p, nil
+}
+
+// duration returns the container duration in seconds, or 0 if unknown.
+func (p *probeResult) duration() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// streams returns the streams of the given codec type (video, audio, ...).
+func (p *probeResult) streams(codecType string) []probeStream {
+	var s []probeStream
+	for _, st := range p.Streams {
+		if st.CodecType == codecType {
+			s = append(s, st)
+		}
+	}
+	return s
+}
+
+// verifyFile checks that filename is playable media with a nonzero duration.
+func verifyFile(filename string) (*probeResult, error) {
+	p, err := probe(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Streams) == 0 {
+		return p, fmt.Errorf("no streams")
+	} else if p.duration() <= 0 {
+		return p, fmt.Errorf("zero duration")
+	}
+	return p, nil
+}
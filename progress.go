@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// progressEvent is a line of the -progress-json stream.
+type progressEvent struct {
+	File    string  `json:"file"`
+	Percent float64 `json:"percent"`
+	FPS     float64 `json:"fps"`
+	ETA     float64 `json:"eta_s"`
+	Done    bool    `json:"done,omitempty"`
+}
+
+// progressStream writes progressEvents as newline delimited JSON. It's safe
+// for concurrent use, so the events of workers never interleave.
+type progressStream struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openProgressStream opens the -progress-json target, a file descriptor
+// number such as 1 for stdout or a path, which is appended to.
+func openProgressStream(target string) (*progressStream, error) {
+	if fd, err := strconv.Atoi(target); err == nil && fd >= 0 {
+		return &progressStream{w: os.NewFile(uintptr(fd), "fd "+target)}, nil
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &progressStream{w: f}, nil
+}
+
+func (s *progressStream) send(ev progressEvent) {
+	data, _ := json.Marshal(ev)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(data, '\n'))
+}
+
+func (s *progressStream) Close() error {
+	return s.w.Close()
+}
+
+// readProgress reads the key=value blocks ffmpeg's -progress writes to r,
+// sending an event for each block about file, whose duration is in
+// seconds. Without a duration the percent and ETA are left 0.
+func (s *progressStream) readProgress(r io.Reader, file string, duration float64) {
+	ev := progressEvent{File: file}
+	var done, speed float64
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(sc.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "fps":
+			ev.FPS, _ = strconv.ParseFloat(kv[1], 64)
+		case "speed":
+			speed, _ = strconv.ParseFloat(strings.TrimSuffix(kv[1], "x"), 64)
+		case "out_time_us":
+			if us, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				done = us / 1e6
+			}
+		case "progress":
+			// ends each block, with end after the last one
+			if kv[1] == "end" {
+				ev.Done, ev.Percent, ev.ETA = true, 100, 0
+			} else if duration > 0 {
+				done = math.Min(done, duration)
+				ev.Percent = math.Round(done/duration*1000) / 10
+				if speed > 0 {
+					ev.ETA = math.Round((duration - done) / speed)
+				}
+			}
+			s.send(ev)
+		}
+	}
+	io.Copy(ioutil.Discard, r)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The -proxy profile's defaults, used unless the flags choosing them are
+// given.
+const (
+	proxyHeight       = 720
+	proxyCRF          = "28"
+	proxyAudioBitrate = "128k"
+)
+
+// applyProxy sets opts and outputs up for -proxy: the sources of dir are
+// kept, and each is re-encoded into a smaller copy at the same place in
+// the tree under proxyDir, its video scaled down to height (0 to keep its
+// size) at crf. A -codec, -acodec or -ab already given is kept, and a
+// -acodec without -ab keeps its encoder's default bitrate.
+func applyProxy(opts *options, outputs *prefixMap, dir, proxyDir string, height int, crf string) error {
+	if height < 0 {
+		return fmt.Errorf("-proxy-height can't be negative")
+	} else if n, err := strconv.ParseFloat(crf, 64); err != nil || n < 0 {
+		return fmt.Errorf("invalid -proxy-crf %q (expected e.g. 28)", crf)
+	}
+	if err := outputs.Set(dir + "=" + proxyDir); err != nil {
+		return fmt.Errorf("-proxy: %v", err)
+	}
+
+	opts.Keep = true
+	if opts.videoCopied() {
+		opts.VideoCodec = transcodeCodecs["video"]
+	}
+	if opts.audioCopied() {
+		opts.AudioCodec = transcodeCodecs["audio"]
+		if opts.AudioBitrate == "" {
+			opts.AudioBitrate = proxyAudioBitrate
+		}
+	}
+	if opts.TargetSize == "" {
+		// -target-size sets the bitrate instead
+		opts.crf = crf
+	}
+	opts.maxHeight = height
+	return nil
+}
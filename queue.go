@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"os"
+	"sync"
+)
+
+// Keys -priority orders queued jobs by.
+const (
+	priorityFIFO = "fifo" // in the order they were queued
+	prioritySize = "size" // smallest source first
+	priorityAge  = "age"  // most recently modified source first
+	priorityTag  = "tag"  // highest priority given to POST /convert first
+)
+
+// queuedJob is a job in a jobQueue. Jobs with a lower rank are converted
+// first, and those with the same rank in the order they were queued.
+type queuedJob struct {
+	job
+	rank int64
+	seq  int
+}
+
+type jobHeap []queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(queuedJob)) }
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	j := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return j
+}
+
+// jobQueue holds the jobs waiting for a worker, handing out the one ranked
+// first by its key each time a worker asks for one. Once ctx is done the
+// jobs still waiting are dropped and no more are accepted. It's safe for
+// concurrent use.
+type jobQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	key    string
+	jobs   jobHeap
+	seq    int
+	closed bool
+	ctx    context.Context
+}
+
+func newJobQueue(ctx context.Context, key string) *jobQueue {
+	q := &jobQueue{key: key, ctx: ctx}
+	q.cond = sync.NewCond(&q.mu)
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		q.jobs = nil
+		q.mu.Unlock()
+		q.cond.Broadcast()
+	}()
+	return q
+}
+
+// rank returns j's place in the queue by q's key.
+func (q *jobQueue) rank(j job) int64 {
+	switch q.key {
+	case priorityTag:
+		return -int64(j.priority)
+	case prioritySize, priorityAge:
+		info, err := os.Stat(j.source)
+		if err != nil {
+			// last, and left for the worker to report
+			return math.MaxInt64
+		}
+		if q.key == prioritySize {
+			return info.Size()
+		}
+		return -info.ModTime().UnixNano()
+	}
+	return 0
+}
+
+// push queues j, returning false if the queue no longer accepts jobs.
+func (q *jobQueue) push(j job) bool {
+	rank := q.rank(j)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.ctx.Err() != nil {
+		return false
+	}
+	q.seq++
+	heap.Push(&q.jobs, queuedJob{job: j, rank: rank, seq: q.seq})
+	q.cond.Signal()
+	return true
+}
+
+// pop blocks until a job is queued and returns the first. It returns false
+// once the queue is closed and empty, or its ctx is done.
+func (q *jobQueue) pop() (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && !q.closed && q.ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	if len(q.jobs) == 0 || q.ctx.Err() != nil {
+		return job{}, false
+	}
+	return heap.Pop(&q.jobs).(queuedJob).job, true
+}
+
+// close stops q accepting jobs. The jobs already queued are still handed
+// out.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
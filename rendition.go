@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renditionRE matches a -rendition: the height of the video, optionally
+// followed by the CRF it's encoded with, e.g. 1080p or 720p:crf25.
+var renditionRE = regexp.MustCompile(`^([1-9][0-9]*)p(?::crf([0-9]+(?:\.[0-9]+)?))?$`)
+
+// rendition is one of several outputs of the same source, its video scaled
+// to a height. Each is named after the source with _<name> appended, e.g.
+// movie_720p.mp4.
+type rendition struct {
+	name   string
+	height int
+	crf    string
+}
+
+// apply returns opts set up to convert the rendition. The video is always
+// re-encoded, with -codec or libx264 by default.
+func (r rendition) apply(opts options) options {
+	opts.suffix = "_" + r.name
+	opts.height = r.height
+	if r.crf != "" {
+		opts.crf = r.crf
+	}
+	if opts.videoCopied() {
+		opts.VideoCodec = transcodeCodecs["video"]
+	}
+	return opts
+}
+
+// renditionList is a repeatable flag of renditions.
+type renditionList []rendition
+
+func (l *renditionList) String() string {
+	s := make([]string, len(*l))
+	for i, r := range *l {
+		s[i] = r.name
+		if r.crf != "" {
+			s[i] += ":crf" + r.crf
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *renditionList) Set(v string) error {
+	m := renditionRE.FindStringSubmatch(v)
+	if m == nil {
+		return fmt.Errorf("invalid rendition %q (expected e.g. 1080p or 720p:crf25)", v)
+	}
+	height, _ := strconv.Atoi(m[1])
+	for _, r := range *l {
+		if r.height == height {
+			return fmt.Errorf("rendition %dp given twice", height)
+		}
+	}
+	*l = append(*l, rendition{name: m[1] + "p", height: height, crf: m[2]})
+	return nil
+}
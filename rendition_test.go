@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenditionListSet(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   renditionList
+		ok     bool
+	}{
+		{[]string{"1080p"}, renditionList{{name: "1080p", height: 1080}}, true},
+		{[]string{"1080p", "720p:crf25"}, renditionList{{name: "1080p", height: 1080}, {name: "720p", height: 720, crf: "25"}}, true},
+		{[]string{"480p:crf23.5"}, renditionList{{name: "480p", height: 480, crf: "23.5"}}, true},
+		{[]string{"720p", "720p:crf30"}, nil, false},
+		{[]string{"720"}, nil, false},
+		{[]string{"0p"}, nil, false},
+		{[]string{"720p:crf"}, nil, false},
+		{[]string{"720p:25"}, nil, false},
+		{[]string{"hd"}, nil, false},
+	}
+	for _, tt := range tests {
+		var l renditionList
+		var err error
+		for _, v := range tt.values {
+			if err = l.Set(v); err != nil {
+				break
+			}
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("Set(%q) = %v, want ok %v", tt.values, err, tt.ok)
+		} else if tt.ok && !reflect.DeepEqual(l, tt.want) {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.values, l, tt.want)
+		}
+	}
+}
+
+func TestRenditionListString(t *testing.T) {
+	l := renditionList{{name: "1080p", height: 1080}, {name: "720p", height: 720, crf: "25"}}
+	if got, want := l.String(), "1080p,720p:crf25"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+func TestRenditionArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		rendition rendition
+		codec     string
+		want      []string
+	}{
+		{"default codec", rendition{name: "720p", height: 720}, "copy",
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-c:v", "libx264", "-vf", "scale=-2:720", "-map_chapters", "0", "out.mp4"}},
+		{"crf", rendition{name: "480p", height: 480, crf: "25"}, "copy",
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-c:v", "libx264", "-vf", "scale=-2:480", "-crf", "25", "-map_chapters", "0", "out.mp4"}},
+		{"-codec kept", rendition{name: "1080p", height: 1080}, "libx265",
+			[]string{"-loglevel", "error", "-i", "in.mkv", "-codec", "copy", "-c:v", "libx265", "-vf", "scale=-2:1080", "-map_chapters", "0", "out.mp4"}},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.VideoCodec = tt.codec
+		if got := ffmpegArgs(tt.rendition.apply(opts), nil, "in.mkv", "out.mp4"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ffmpegArgs = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenditionOutputPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		w         *worker
+		source    string
+		matchCase bool
+		want      string
+	}{
+		{"beside", &worker{}, filepath.Join("shows", "ep1.mkv"), false, filepath.Join("shows", "ep1_720p.mp4")},
+		{"match case", &worker{}, "Movie.MKV", true, "Movie_720p.MP4"},
+		{"subdir", &worker{outSubdir: "converted"}, filepath.Join("shows", "ep1.mkv"), false, filepath.Join("shows", "converted", "ep1_720p.mp4")},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.MatchCase = tt.matchCase
+		opts = rendition{name: "720p", height: 720}.apply(opts)
+		if got := tt.w.outputPath(tt.source, opts); got != tt.want {
+			t.Errorf("%s: outputPath(%q) = %q, want %q", tt.name, tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestRenditionParts(t *testing.T) {
+	w := &worker{renditions: renditionList{{name: "1080p", height: 1080}, {name: "720p", height: 720, crf: "25"}}}
+	kind, parts, err := w.parts("movie.mkv", defaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, outputs []string
+	for _, p := range parts {
+		names = append(names, p.name)
+		outputs = append(outputs, w.outputPath("movie.mkv", p.opts))
+	}
+	if kind != "renditions" {
+		t.Errorf("parts are %q, want renditions", kind)
+	}
+	if want := []string{"rendition 1080p", "rendition 720p"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("parts = %q, want %q", names, want)
+	}
+	if want := []string{"movie_1080p.mp4", "movie_720p.mp4"}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("outputs = %q, want %q", outputs, want)
+	}
+}
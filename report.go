@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statusConverted  = "converted"
+	statusSkipped    = "skipped"
+	statusUnreadable = "unreadable"     // skipped since the source couldn't be read
+	statusNoStream   = "missing-stream" // skipped for lacking a -require-video or -require-audio stream
+	statusFailed     = "failed"
+	statusVerified   = "verified"
+	statusPlanned    = "planned"
+)
+
+// result describes the outcome of processing a single source file.
+type result struct {
+	source     string
+	output     string
+	status     string
+	sourceSize int64
+	outputSize int64
+	duration   time.Duration
+	err        error
+}
+
+// csvReport writes one row per finished file. It's safe for concurrent use.
+type csvReport struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+func newCSVReport(path string) (*csvReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &csvReport{f: f, w: csv.NewWriter(f)}
+	r.w.Write([]string{"source", "output", "status", "source_size", "output_size", "duration_seconds", "error"})
+	r.w.Flush()
+	if err = r.w.Error(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *csvReport) add(res result) error {
+	var errMsg string
+	if res.err != nil {
+		errMsg = res.err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write([]string{
+		res.source,
+		res.output,
+		res.status,
+		strconv.FormatInt(res.sourceSize, 10),
+		strconv.FormatInt(res.outputSize, 10),
+		fmt.Sprintf("%.3f", res.duration.Seconds()),
+		errMsg,
+	})
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func (r *csvReport) Close() error {
+	return r.f.Close()
+}
+
+// summary totals the results of a run. It's safe for concurrent use.
+type summary struct {
+	mu         sync.Mutex
+	start      time.Time
+	counts     map[string]int
+	bytesIn    int64
+	bytesOut   int64
+	busy       time.Duration // total time spent processing files
+	failed     []result
+	notes      []string
+	stopReason string
+}
+
+func newSummary() *summary {
+	return &summary{start: time.Now(), counts: make(map[string]int)}
+}
+
+// add records res, returning the total size of the outputs written so far.
+func (s *summary) add(res result) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[res.status]++
+	s.busy += res.duration
+	switch res.status {
+	case statusConverted:
+		s.bytesIn += res.sourceSize
+		s.bytesOut += res.outputSize
+	case statusFailed:
+		s.failed = append(s.failed, res)
+	}
+	return s.bytesOut
+}
+
+// stop records why the run stopped before all files were handled. Only the
+// first reason is kept.
+func (s *summary) stop(reason string) {
+	s.mu.Lock()
+	if s.stopReason == "" {
+		s.stopReason = reason
+	}
+	s.mu.Unlock()
+}
+
+// note adds a remark about the run to the summary.
+func (s *summary) note(n string) {
+	s.mu.Lock()
+	s.notes = append(s.notes, n)
+	s.mu.Unlock()
+}
+
+// failures returns the failed results sorted by source.
+func (s *summary) failures() []result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := append([]result(nil), s.failed...)
+	sort.Slice(results, func(i, j int) bool { return results[i].source < results[j].source })
+	return results
+}
+
+func (s *summary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	str := fmt.Sprintf("Converted %d, skipped %d, failed %d%s in %s",
+		s.counts[statusConverted], s.counts[statusSkipped], s.counts[statusFailed],
+		s.failureKinds(), time.Since(s.start).Round(time.Second))
+	if s.counts[statusUnreadable] > 0 {
+		str += fmt.Sprintf(", unreadable %d", s.counts[statusUnreadable])
+	}
+	if s.counts[statusNoStream] > 0 {
+		str += fmt.Sprintf(", missing streams %d", s.counts[statusNoStream])
+	}
+	if s.counts[statusVerified] > 0 {
+		str += fmt.Sprintf(", verified %d", s.counts[statusVerified])
+	}
+	if s.counts[statusPlanned] > 0 {
+		str += fmt.Sprintf(", planned %d", s.counts[statusPlanned])
+	}
+	if s.bytesIn > 0 {
+		str += fmt.Sprintf("; read %s, wrote %s", formatSize(s.bytesIn), formatSize(s.bytesOut))
+	}
+	for _, n := range s.notes {
+		str += "; " + n
+	}
+	if s.stopReason != "" {
+		str += "; stopped early: " + s.stopReason
+	}
+	return str
+}
+
+// jsonSummary is the document written by -summary-json.
+type jsonSummary struct {
+	Start              time.Time      `json:"start"`
+	End                time.Time      `json:"end"`
+	ElapsedSeconds     float64        `json:"elapsed_seconds"`
+	Counts             map[string]int `json:"counts"`
+	TotalFileSeconds   float64        `json:"total_file_seconds"`
+	AverageFileSeconds float64        `json:"average_file_seconds"`
+	BytesIn            int64          `json:"bytes_in"`
+	BytesOut           int64          `json:"bytes_out"`
+	Failures           []jsonFailure  `json:"failures"`
+	Notes              []string       `json:"notes,omitempty"`
+	StopReason         string         `json:"stop_reason,omitempty"`
+}
+
+type jsonFailure struct {
+	Source string `json:"source"`
+	Output string `json:"output,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	Error  string `json:"error"`
+}
+
+// writeJSON writes the summary so far to path as a jsonSummary.
+func (s *summary) writeJSON(path string) error {
+	failures := s.failures()
+	s.mu.Lock()
+	end := time.Now()
+	doc := jsonSummary{
+		Start:            s.start,
+		End:              end,
+		ElapsedSeconds:   end.Sub(s.start).Seconds(),
+		Counts:           s.counts,
+		TotalFileSeconds: s.busy.Seconds(),
+		BytesIn:          s.bytesIn,
+		BytesOut:         s.bytesOut,
+		Failures:         []jsonFailure{},
+		Notes:            s.notes,
+		StopReason:       s.stopReason,
+	}
+	files := 0
+	for _, n := range s.counts {
+		files += n
+	}
+	if files > 0 {
+		doc.AverageFileSeconds = s.busy.Seconds() / float64(files)
+	}
+	for _, res := range failures {
+		f := jsonFailure{Source: res.source, Output: res.output, Error: res.err.Error()}
+		for _, e := range errorNames {
+			if errorKind(res.err) == e.kind {
+				f.Kind = e.name
+			}
+		}
+		doc.Failures = append(doc.Failures, f)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// failureKinds counts the failures by their kind of error, e.g.
+// " (2 ffmpeg not found)". It must be called with s.mu held.
+func (s *summary) failureKinds() string {
+	var parts []string
+	for _, e := range errorNames {
+		n := 0
+		for _, res := range s.failed {
+			if errorKind(res.err) == e.kind {
+				n++
+			}
+		}
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %v", n, e.kind))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,34 @@
+package main
+
+import "fmt"
+
+// hasVideo reports whether p has a video stream that isn't cover art.
+func hasVideo(p *probeResult) bool {
+	for _, st := range p.streams("video") {
+		if !isCover(st) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequired returns an error wrapping ErrNoVideo or ErrNoAudio when
+// filename lacks a stream -require-video or -require-audio asks for, such
+// as an audio-only file named .mkv that a copy would turn into a
+// surprising MP4. -require-video doesn't apply with -audio-only.
+func (o *options) checkRequired(filename string) error {
+	video := o.RequireVideo && !o.AudioOnly
+	if !video && !o.RequireAudio {
+		return nil
+	}
+	p, err := probe(filename)
+	if err != nil {
+		return fmt.Errorf("probing source: %v", err)
+	}
+	if video && !hasVideo(p) {
+		return fmt.Errorf("%w (use -require-video=false to convert it anyway)", ErrNoVideo)
+	} else if o.RequireAudio && len(p.streams("audio")) == 0 {
+		return ErrNoAudio
+	}
+	return nil
+}
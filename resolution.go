@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// resolutionFilter is the -only-resolution predicate on a source's video
+// height, such as ">=2160".
+type resolutionFilter struct {
+	op     string // ">=", "<=" or "=="
+	height int
+}
+
+// resolutionNames are the shorthands -only-resolution takes besides heights
+// like 1080 or 1080p.
+var resolutionNames = map[string]int{"4k": 2160, "uhd": 2160, "8k": 4320}
+
+// parseResolutionFilter parses an -only-resolution value: a height or
+// shorthand, optionally preceded by >=, <= or == (the default).
+func parseResolutionFilter(s string) (*resolutionFilter, error) {
+	f := &resolutionFilter{op: "=="}
+	v := strings.ToLower(strings.TrimSpace(s))
+	for _, op := range []string{">=", "<=", "=="} {
+		if strings.HasPrefix(v, op) {
+			f.op, v = op, strings.TrimSpace(v[len(op):])
+			break
+		}
+	}
+	if h, ok := resolutionNames[v]; ok {
+		f.height = h
+		return f, nil
+	}
+	h, err := strconv.Atoi(strings.TrimSuffix(v, "p"))
+	if err != nil || h <= 0 {
+		return nil, fmt.Errorf("invalid -only-resolution %q (expected e.g. >=2160, <=720p or 4k)", s)
+	}
+	f.height = h
+	return f, nil
+}
+
+func (f *resolutionFilter) String() string {
+	return fmt.Sprintf("%s%d", f.op, f.height)
+}
+
+// matches reports whether a video of the given height passes f.
+func (f *resolutionFilter) matches(height int) bool {
+	switch f.op {
+	case ">=":
+		return height >= f.height
+	case "<=":
+		return height <= f.height
+	}
+	return height == f.height
+}
+
+// videoHeight returns the height class of the first video stream of p that
+// isn't cover art, along with its size for log output, or false without
+// one. Video cropped to a wider ratio than 16:9 is classed by its width, so
+// a 1920x800 film counts as 1080, and portrait video by its shorter side.
+func videoHeight(p *probeResult) (int, string, bool) {
+	for _, st := range p.streams("video") {
+		if isCover(st) || st.Width <= 0 || st.Height <= 0 {
+			continue
+		}
+		long, short := st.Width, st.Height
+		if short > long {
+			long, short = short, long
+		}
+		height := short
+		if h := (long*9 + 8) / 16; h > height {
+			height = h
+		}
+		return height, fmt.Sprintf("%dx%d", st.Width, st.Height), true
+	}
+	return 0, "", false
+}
+
+// matchResolution reports whether the video of filename passes f, probing
+// it with ffprobe (whose result is cached for its conversion). When it
+// doesn't, reason says why.
+func (f *resolutionFilter) matchResolution(filename string) (ok bool, reason string) {
+	p, err := probe(filename)
+	if err != nil {
+		return false, fmt.Sprintf("couldn't read its resolution: %v", err)
+	}
+	height, size, found := videoHeight(p)
+	if !found {
+		return false, fmt.Sprintf("has no video to match -only-resolution %s", f)
+	}
+	if !f.matches(height) {
+		return false, fmt.Sprintf("its video is %s (%dp), not %s", size, height, f)
+	}
+	return true, ""
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// resumePoint finds where a conversion into the segments of pattern can
+// carry on after an interrupted run. The run's segments are checked with
+// ffprobe in order up to the first missing or broken one, and the last good
+// one is converted again too, since it may have been cut short. It returns
+// the number of the first segment to write, how many seconds of the source
+// the segments before it hold, all the segments found and whether every
+// one of them is good.
+func resumePoint(pattern string) (next int, start float64, segments []string, complete bool, err error) {
+	if segments, err = segmentFiles(pattern); err != nil {
+		return 0, 0, nil, false, err
+	}
+	var durations []float64
+	for i, s := range segments {
+		if filepath.Clean(fmt.Sprintf(pattern, i)) != filepath.Clean(s) {
+			break
+		}
+		p, err := verifyFile(s)
+		if err != nil {
+			break
+		}
+		durations = append(durations, p.duration())
+	}
+	if len(durations) == 0 {
+		return 0, 0, segments, false, nil
+	}
+	next = len(durations) - 1
+	for _, d := range durations[:next] {
+		start += d
+	}
+	return next, start, segments, len(durations) == len(segments), nil
+}
+
+// resumeSegments sets opts up to carry on converting filename into the
+// segments of pattern left by an earlier run, removing those converted
+// again. It reports false when there are none, or they already hold the
+// whole source, which are then treated like any other existing output.
+func (w *worker) resumeSegments(filename, pattern string, opts options) (bool, options, error) {
+	next, start, segments, complete, err := resumePoint(pattern)
+	if err != nil || len(segments) == 0 {
+		return false, opts, err
+	}
+	if complete {
+		if p, err := probe(filename); err == nil && start+lastDuration(segments) >= p.duration()-1 {
+			return false, opts, nil
+		}
+	}
+
+	if !w.dryRun {
+		for _, s := range segments[next:] {
+			os.Remove(s)
+		}
+	}
+	if next == 0 {
+		w.logger.Printf("Converting %s from the start, none of its segments can be kept\n", filename)
+		return true, opts, nil
+	}
+	w.logger.Printf("Resuming %s at segment %d, %.1fs in\n", filename, next, start)
+	opts.resumeAt = strconv.FormatFloat(start, 'f', 3, 64)
+	opts.segmentStart = next
+	return true, opts, nil
+}
+
+// lastDuration returns the duration of the last of segments, or 0 if it
+// can't be probed.
+func lastDuration(segments []string) float64 {
+	p, err := probe(segments[len(segments)-1])
+	if err != nil {
+		return 0
+	}
+	return p.duration()
+}
+
+// partDone reports whether out, an output of one of a source's parts, was
+// already converted by an earlier run, removing it when it's broken.
+func (w *worker) partDone(out string) bool {
+	if _, err := os.Stat(out); err != nil {
+		return false
+	}
+	if _, err := verifyFile(out); err != nil {
+		w.logger.Printf("Converting %s again: %v\n", out, err)
+		if !w.dryRun {
+			os.Remove(out)
+		}
+		return false
+	}
+	return true
+}
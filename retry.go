@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts.
+const maxRetryDelay = 10 * time.Minute
+
+// defaultKindRetries are the retries of the kinds of failure that come out
+// the same however often they're retried.
+var defaultKindRetries = map[error]int{
+	ErrFFmpegNotFound:    0,
+	ErrIncompatibleCodec: 0,
+	ErrOutputExists:      0,
+	ErrUpToDate:          0,
+	ErrUnreadable:        0,
+	ErrChecksum:          0,
+	ErrHardlink:          0,
+	ErrTimeout:           0,
+	ErrSourceCorrupt:     0,
+	ErrDiskFull:          0,
+	ErrNoInodes:          0,
+	ErrHWDevice:          0,
+	ErrHook:              0, // the output is in place, so converting again fails
+	ErrSink:              0, // retried by the upload itself, also with the output in place
+}
+
+// retryPolicy decides how often and after what delay a failed conversion is
+// retried.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	byKind  kindRetries // overrides retries for a kind of failure
+}
+
+// retriesFor returns how many times a conversion failing with err is
+// retried.
+func (p retryPolicy) retriesFor(err error) int {
+	kind := errorKind(err)
+	if n, ok := p.byKind[kind]; ok {
+		return n
+	} else if n, ok := defaultKindRetries[kind]; ok {
+		return n
+	}
+	return p.retries
+}
+
+// delay returns how long to wait before the given retry (1 for the first).
+// Delays double from the backoff base up to maxRetryDelay, with jitter of up
+// to half the delay so concurrent workers don't retry in lockstep.
+func (p retryPolicy) delay(retry int) time.Duration {
+	if p.backoff <= 0 {
+		return 0
+	}
+	d := p.backoff
+	for i := 1; i < retry && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// kindRetries is a repeatable kind=n flag setting the retries of a kind of
+// failure, such as network=3.
+type kindRetries map[error]int
+
+func (k *kindRetries) String() string {
+	if k == nil {
+		return ""
+	}
+	var s []string
+	for _, e := range errorNames {
+		if n, ok := (*k)[e.kind]; ok {
+			s = append(s, e.name+"="+strconv.Itoa(n))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (k *kindRetries) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("expected kind=retries, got %q", v)
+	}
+	kind, ok := errorByName(v[:i])
+	if !ok {
+		return fmt.Errorf("unknown kind of failure %q (expected one of %s)", v[:i], kindNames())
+	}
+	n, err := strconv.Atoi(v[i+1:])
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number of retries %q", v[i+1:])
+	}
+	if *k == nil {
+		*k = make(kindRetries)
+	}
+	(*k)[kind] = n
+	return nil
+}
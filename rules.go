@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A rules file decides per stream how it's converted, based on the codecs
+// reported by ffprobe. Each line holds a rule:
+//
+//	<stream type> <codec pattern> <action> [encoder options...]
+//
+//	video    hevc    copy
+//	video    vp9     libx264 -crf 20
+//	audio    dts     aac -b 192k
+//	subtitle hdmv_*  drop
+//
+// The stream type is video, audio, subtitle, data, attachment or *. The
+// codec pattern is matched against ffprobe's codec_name like a shell glob.
+// The action is copy, drop or the encoder to transcode with. Encoder options
+// without a stream specifier are applied to that stream only, so -crf 20
+// becomes -crf:<n> 20. Blank lines and lines starting with # are ignored.
+//
+// For each stream the first matching rule in the file wins. Streams no rule
+// matches fall back to defaultRules, which keep MP4 compatible codecs and
+// transcode or drop the rest.
+type rule struct {
+	streamType string
+	pattern    string
+	action     string
+	args       []string
+}
+
+type ruleSet []rule
+
+const (
+	ruleCopy = "copy"
+	ruleDrop = "drop"
+)
+
+var defaultRules = mustParseRules(`
+video      h264       copy
+video      hevc       copy
+video      mpeg4      copy
+video      av1        copy
+video      mjpeg      copy
+video      png        copy
+video      *          libx264 -crf 20
+audio      aac        copy
+audio      mp3        copy
+audio      ac3        copy
+audio      eac3       copy
+audio      alac       copy
+audio      opus       copy
+audio      flac       copy
+audio      *          aac
+subtitle   mov_text   copy
+subtitle   subrip     mov_text
+subtitle   ass        mov_text
+subtitle   ssa        mov_text
+subtitle   webvtt     mov_text
+subtitle   *          drop
+*          *          drop
+`)
+
+func mustParseRules(s string) ruleSet {
+	rs, err := parseRules(strings.NewReader(s))
+	if err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+func loadRules(filename string) (ruleSet, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs, err := parseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return rs, nil
+}
+
+func parseRules(r io.Reader) (ruleSet, error) {
+	rs := ruleSet{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected <stream type> <codec pattern> <action>", n)
+		}
+		ru := rule{streamType: fields[0], pattern: fields[1], action: fields[2], args: fields[3:]}
+		switch ru.streamType {
+		case "video", "audio", "subtitle", "data", "attachment", "*":
+		default:
+			return nil, fmt.Errorf("line %d: unknown stream type %q", n, ru.streamType)
+		}
+		if _, err := path.Match(ru.pattern, ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid codec pattern %q", n, ru.pattern)
+		}
+		if (ru.action == ruleCopy || ru.action == ruleDrop) && len(ru.args) > 0 {
+			return nil, fmt.Errorf("line %d: %s doesn't take encoder options", n, ru.action)
+		}
+		rs = append(rs, ru)
+	}
+	return rs, s.Err()
+}
+
+func (ru rule) matches(st probeStream) bool {
+	if ru.streamType != "*" && ru.streamType != st.CodecType {
+		return false
+	}
+	ok, _ := path.Match(ru.pattern, st.CodecName)
+	return ok
+}
+
+// match returns the rule deciding how st is converted.
+func (rs ruleSet) match(st probeStream) rule {
+	for _, set := range []ruleSet{rs, defaultRules} {
+		for _, ru := range set {
+			if ru.matches(st) {
+				return ru
+			}
+		}
+	}
+	return rule{action: ruleCopy}
+}
+
+// mapped returns the streams of p that aren't dropped, in output order.
+func (rs ruleSet) mapped(p *probeResult) []probeStream {
+	var streams []probeStream
+	for _, st := range p.Streams {
+		if rs.match(st).action != ruleDrop {
+			streams = append(streams, st)
+		}
+	}
+	return streams
+}
+
+// streamArgs returns the -map and per-stream codec arguments for the
+// streams in p.
+func (rs ruleSet) streamArgs(p *probeResult) []string {
+	var args []string
+	for out, st := range rs.mapped(p) {
+		ru := rs.match(st)
+		n := strconv.Itoa(out)
+		args = append(args, "-map", "0:"+strconv.Itoa(st.Index), "-c:"+n, ru.action)
+		for _, a := range ru.args {
+			if isOption(a) && !strings.Contains(a, ":") {
+				a += ":" + n
+			}
+			args = append(args, a)
+		}
+	}
+	return args
+}
+
+// isOption reports whether a is an option name rather than a value such as -5.
+func isOption(a string) bool {
+	if !strings.HasPrefix(a, "-") {
+		return false
+	}
+	_, err := strconv.ParseFloat(a, 64)
+	return err != nil
+}
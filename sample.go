@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// sampler picks a random subset of n of the matched files. The same seed
+// picks the same files from the same list.
+type sampler struct {
+	n    int
+	seed int64
+
+	picked, of int // the size of the last sample and of the list it's from
+}
+
+// pick returns the sorted indexes of the sample from a list of total files.
+func (s *sampler) pick(total int) []int {
+	s.of = total
+	var idx []int
+	if total <= s.n {
+		idx = make([]int, total)
+		for i := range idx {
+			idx[i] = i
+		}
+	} else {
+		idx = rand.New(rand.NewSource(s.seed)).Perm(total)[:s.n]
+		sort.Ints(idx)
+	}
+	s.picked = len(idx)
+	return idx
+}
+
+func (s *sampler) pickFiles(files []string) []string {
+	var sample []string
+	for _, i := range s.pick(len(files)) {
+		sample = append(sample, files[i])
+	}
+	return sample
+}
+
+func (s *sampler) pickJobs(jobs []job) []job {
+	var sample []job
+	for _, i := range s.pick(len(jobs)) {
+		sample = append(sample, jobs[i])
+	}
+	return sample
+}
+
+func (s *sampler) String() string {
+	return fmt.Sprintf("sampled %d of %d files with -seed %d", s.picked, s.of, s.seed)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// scanner finds the files to convert in a directory tree.
+type scanner struct {
+	match     *matcher
+	recurse   bool
+	orderDirs string // orderPre, orderPost or "" for plain path order
+	natural   bool   // compare names with naturalLess
+	dedupe    *deduper
+	sample    *sampler
+	inFlight  *inFlight
+	workers   int
+
+	// limit caps how many files are queued, 0 for no limit. matched and
+	// queued count the files found and queued.
+	limit   int
+	matched int
+	queued  int
+
+	logger    *log.Logger
+	errLogger *log.Logger
+}
+
+// convertDirectory queues the matching files in dirname in sorted order.
+func (s *scanner) convertDirectory(dirname string, queue *jobQueue) error {
+	files, err := s.findFiles(dirname)
+	if err != nil {
+		return err
+	}
+	if s.dedupe != nil {
+		files = s.removeDuplicates(files)
+	}
+	if s.sample != nil {
+		files = s.sample.pickFiles(files)
+	}
+	jobs := make([]job, len(files))
+	for i, path := range files {
+		jobs[i] = job{source: path}
+	}
+	s.dispatch(jobs, queue)
+	return nil
+}
+
+// convertFile queues filename, which must be selected by s.match unless
+// force is set.
+func (s *scanner) convertFile(filename string, force bool, queue *jobQueue) error {
+	if err := checkInput(filename, s.match, force); err != nil {
+		return err
+	}
+	s.dispatch([]job{{source: filename}}, queue)
+	return nil
+}
+
+// findFiles returns the matching files in dirname, sorted.
+func (s *scanner) findFiles(dirname string) ([]string, error) {
+	var (
+		mu    sync.Mutex
+		files []string
+	)
+	err := s.walk(dirname, func(path string, info os.FileInfo) {
+		mu.Lock()
+		files = append(files, path)
+		mu.Unlock()
+	})
+	less := func(a, b string) bool { return a < b }
+	if s.natural {
+		less = naturalLess
+	}
+	switch s.orderDirs {
+	case orderPre, orderPost:
+		sort.Slice(files, func(i, j int) bool {
+			return dirOrderLess(files[i], files[j], s.orderDirs == orderPre, less)
+		})
+	default:
+		sort.Slice(files, func(i, j int) bool { return less(files[i], files[j]) })
+	}
+	return files, err
+}
+
+// Orders of a directory's own files and its subdirectories' for -order-dirs.
+const (
+	orderPre  = "pre"  // a directory's files before its subdirectories'
+	orderPost = "post" // a directory's subdirectories' files before its own
+)
+
+// dirOrderLess compares the paths a and b one element at a time with less,
+// putting a directory's own files before the files in its subdirectories
+// when filesFirst, and after them otherwise.
+func dirOrderLess(a, b string, filesFirst bool, less func(a, b string) bool) bool {
+	as := strings.Split(filepath.ToSlash(a), "/")
+	bs := strings.Split(filepath.ToSlash(b), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		aFile, bFile := i == len(as)-1, i == len(bs)-1
+		if aFile != bFile {
+			return aFile == filesFirst
+		}
+		return less(as[i], bs[i])
+	}
+	return len(as) < len(bs)
+}
+
+// removeDuplicates drops the files with the same content as an earlier one.
+// Every file is hashed before any are queued, so no source is removed while
+// it may still be needed for a comparison.
+func (s *scanner) removeDuplicates(files []string) []string {
+	var unique []string
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			s.errLogger.Printf("Error checking %s for duplicates: %v", path, err)
+			continue
+		}
+		original, err := s.dedupe.duplicateOf(path, info.Size())
+		if err != nil {
+			s.errLogger.Printf("Error checking %s for duplicates: %v", path, err)
+		} else if original != "" {
+			s.logger.Printf("Skipping %s, same content as %s\n", path, original)
+			continue
+		}
+		unique = append(unique, path)
+	}
+	return unique
+}
+
+// dispatch pushes jobs onto queue until it stops accepting them or s.limit
+// files are queued, skipping the ones whose source is already queued.
+func (s *scanner) dispatch(jobs []job, queue *jobQueue) {
+	s.matched += len(jobs)
+	for _, j := range jobs {
+		if s.limit > 0 && s.queued >= s.limit {
+			return
+		}
+		if !s.inFlight.add(j.source) {
+			s.logger.Printf("Skipping %s, already queued\n", j.source)
+			continue
+		}
+		if !queue.push(j) {
+			s.inFlight.remove(j.source)
+			return
+		}
+		s.queued++
+	}
+}
+
+// walk calls fn for each matching file in dirname. With more than one scan
+// worker, directories are read concurrently and fn must be safe for
+// concurrent use. walk returns once every directory has been read.
+func (s *scanner) walk(dirname string, fn func(path string, info os.FileInfo)) error {
+	if info, err := os.Stat(dirname); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s not a directory", dirname)
+	}
+
+	if s.workers > 1 && s.recurse {
+		s.walkParallel(dirname, fn)
+		return nil
+	}
+	return s.walkDir(dirname, fn)
+}
+
+func (s *scanner) walkDir(dirname string, fn func(path string, info os.FileInfo)) error {
+	subdirs, err := s.readDir(dirname, fn)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subdirs {
+		s.walkDir(sub, fn)
+	}
+	return nil
+}
+
+// walkParallel reads directories with a pool of s.workers goroutines fed
+// from a shared queue of directories still to read.
+func (s *scanner) walkParallel(dirname string, fn func(path string, info os.FileInfo)) {
+	var (
+		mu      sync.Mutex
+		cond    = sync.NewCond(&mu)
+		queue   = []string{dirname}
+		pending = 1 // directories queued or being read
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 {
+					cond.Wait()
+				}
+				if len(queue) == 0 {
+					mu.Unlock()
+					return
+				}
+				dir := queue[0]
+				queue = queue[1:]
+				mu.Unlock()
+
+				subdirs, err := s.readDir(dir, fn)
+				if err != nil {
+					s.errLogger.Printf("Error reading %s: %v", dir, err)
+				}
+
+				mu.Lock()
+				queue = append(queue, subdirs...)
+				pending += len(subdirs) - 1
+				cond.Broadcast()
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// readDir calls fn for each matching file in dirname and, when recursing,
+// returns its subdirectories.
+func (s *scanner) readDir(dirname string, fn func(path string, info os.FileInfo)) ([]string, error) {
+	if !strings.HasSuffix(dirname, "/") {
+		dirname += "/"
+	}
+
+	files, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	var subdirs []string
+	for _, f := range files {
+		path := dirname + f.Name()
+		if f.IsDir() {
+			if s.recurse && s.match.matchDir(path) {
+				subdirs = append(subdirs, path)
+			}
+			continue
+		}
+
+		if ok, reason := s.match.match(path, f); !ok {
+			if reason != "" {
+				s.logger.Printf("Skipping %s, %s\n", path, reason)
+			}
+			continue
+		}
+		fn(path, f)
+	}
+	return subdirs, nil
+}
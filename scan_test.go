@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTree creates each of the slash separated names under dir, with
+// any directories they need.
+func writeTree(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// relPaths returns paths relative to dir, with slashes.
+func relPaths(t *testing.T, dir string, paths []string) []string {
+	t.Helper()
+	var rel []string
+	for _, p := range paths {
+		r, err := filepath.Rel(dir, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	return rel
+}
+
+func TestFindFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, "a.mkv", "b.txt", ".c.mkv", "sub/d.mkv", "sub/notes.txt", "sub/deeper/e.mkv", ".hidden/f.mkv")
+
+	tests := []struct {
+		name       string
+		recurse    bool
+		skipHidden bool
+		workers    int
+		want       []string
+	}{
+		{"top level", false, false, 1, []string{".c.mkv", "a.mkv"}},
+		{"recursive", true, false, 1, []string{".c.mkv", ".hidden/f.mkv", "a.mkv", "sub/d.mkv", "sub/deeper/e.mkv"}},
+		{"recursive in parallel", true, false, 4, []string{".c.mkv", ".hidden/f.mkv", "a.mkv", "sub/d.mkv", "sub/deeper/e.mkv"}},
+		{"top level without hidden", false, true, 1, []string{"a.mkv"}},
+		{"recursive without hidden", true, true, 1, []string{"a.mkv", "sub/d.mkv", "sub/deeper/e.mkv"}},
+		{"parallel without hidden", true, true, 4, []string{"a.mkv", "sub/d.mkv", "sub/deeper/e.mkv"}},
+	}
+	for _, tt := range tests {
+		logger := log.New(ioutil.Discard, "", 0)
+		m := &matcher{exts: []string{".mkv"}, skipHidden: tt.skipHidden}
+		s := &scanner{match: m, recurse: tt.recurse, workers: tt.workers, logger: logger, errLogger: logger}
+		files, err := s.findFiles(dir)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := relPaths(t, dir, files); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: findFiles = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindFilesNotDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, "a.mkv")
+	s := &scanner{match: &matcher{exts: []string{".mkv"}}}
+	if _, err := s.findFiles(filepath.Join(dir, "a.mkv")); err == nil {
+		t.Error("findFiles of a file succeeded")
+	}
+	if _, err := s.findFiles(filepath.Join(dir, "missing")); err == nil {
+		t.Error("findFiles of a missing directory succeeded")
+	}
+}
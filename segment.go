@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// segmentPattern returns the segment muxer pattern naming the segments of
+// output, e.g. movie_%03d.mp4 for movie.mp4.
+func segmentPattern(output string) string {
+	ext := filepath.Ext(output)
+	base := strings.Replace(strings.TrimSuffix(output, ext), "%", "%%", -1)
+	return base + "_%03d" + strings.Replace(ext, "%", "%%", -1)
+}
+
+// firstSegment returns the name of the first segment written to pattern.
+func firstSegment(pattern string) string {
+	return fmt.Sprintf(pattern, 0)
+}
+
+// segmentFiles returns the segments written to pattern so far, in order.
+func segmentFiles(pattern string) ([]string, error) {
+	first := firstSegment(pattern)
+	dir := filepath.Dir(first)
+	i := strings.LastIndex(filepath.Base(first), "_000")
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a segment pattern", pattern)
+	}
+	prefix, suffix := filepath.Base(first)[:i+1], filepath.Base(first)[i+4:]
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix)+3 {
+			continue
+		}
+		if _, err := strconv.Atoi(name[len(prefix) : len(name)-len(suffix)]); err == nil {
+			segments = append(segments, filepath.Join(dir, name))
+		}
+	}
+	// the numbers are zero padded to the same width up to 999
+	sort.Slice(segments, func(i, j int) bool {
+		if len(segments[i]) != len(segments[j]) {
+			return len(segments[i]) < len(segments[j])
+		}
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+// removeSegments removes the segments written to pattern.
+func removeSegments(pattern string) {
+	segments, _ := segmentFiles(pattern)
+	for _, s := range segments {
+		os.Remove(s)
+	}
+}
+
+// outputFiles returns the files a conversion wrote to output, which is a
+// segment pattern with -segment.
+func (w *worker) outputFiles(output string) ([]string, error) {
+	if w.segment == "" {
+		return []string{output}, nil
+	}
+	segments, err := segmentFiles(output)
+	if err == nil && len(segments) == 0 {
+		err = fmt.Errorf("no segments written")
+	}
+	return segments, err
+}
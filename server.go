@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued = "queued"
+	jobActive = "active"
+	jobDone   = "done"
+	jobFailed = "failed"
+)
+
+// jobInfo is the state of a job submitted over the HTTP API.
+type jobInfo struct {
+	ID       string     `json:"id"`
+	Source   string     `json:"source"`
+	Output   string     `json:"output,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// jobTracker tracks the state of the jobs submitted over the HTTP API.
+// Workers report progress through start and finish.
+type jobTracker struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*jobInfo
+	order  []string
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: make(map[string]*jobInfo)}
+}
+
+// add records a new queued job for source.
+func (t *jobTracker) add(source string) jobInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	id := strconv.Itoa(t.nextID)
+	info := &jobInfo{ID: id, Source: source, State: jobQueued, Queued: time.Now()}
+	t.jobs[id] = info
+	t.order = append(t.order, id)
+	return *info
+}
+
+func (t *jobTracker) start(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if info, ok := t.jobs[id]; ok {
+		now := time.Now()
+		info.State = jobActive
+		info.Started = &now
+	}
+}
+
+func (t *jobTracker) finish(id string, res result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if info, ok := t.jobs[id]; ok {
+		now := time.Now()
+		info.Output = res.output
+		info.Finished = &now
+		info.State = jobDone
+		if res.err != nil {
+			info.State = jobFailed
+			info.Error = res.err.Error()
+		}
+	}
+}
+
+func (t *jobTracker) get(id string) (jobInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.jobs[id]
+	if !ok {
+		return jobInfo{}, false
+	}
+	return *info, true
+}
+
+// counts returns the number of jobs in each state.
+func (t *jobTracker) counts() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := map[string]int{jobQueued: 0, jobActive: 0, jobDone: 0, jobFailed: 0}
+	for _, info := range t.jobs {
+		counts[info.State]++
+	}
+	return counts
+}
+
+func (t *jobTracker) list() []jobInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]jobInfo, 0, len(t.order))
+	for _, id := range t.order {
+		jobs = append(jobs, *t.jobs[id])
+	}
+	return jobs
+}
+
+// convertRequest is the body of POST /convert. Options are applied over the
+// options given on the command line.
+type convertRequest struct {
+	Source   string          `json:"source"`
+	Options  json.RawMessage `json:"options"`
+	Priority int             `json:"priority"` // higher first, with -priority tag
+}
+
+type apiServer struct {
+	jobs      *jobTracker
+	inFlight  *inFlight
+	queue     *jobQueue
+	defaults  options
+	match     *matcher // selects the sources accepted, as for -d
+	root      string   // the sources accepted are under it, from sourceRoot
+	workers   int
+	ffmpegErr error // why ffmpeg can't be run, checked once at startup
+}
+
+// sourceRoot returns the absolute path of the -serve-root directory dir,
+// with symlinks resolved.
+func sourceRoot(dir string) (string, error) {
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("-serve-root %s isn't a directory", dir)
+	}
+	return root, nil
+}
+
+// checkSource returns the absolute path of source, with symlinks resolved,
+// if it's a file under s.root that a scan of it would pick up. Otherwise it
+// returns the HTTP status to reject the request with.
+func (s *apiServer) checkSource(source string) (string, int, error) {
+	path, err := filepath.Abs(source)
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if !inDir(path, s.root) {
+		return "", http.StatusForbidden, fmt.Errorf("%s isn't under %s", source, s.root)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	} else if info.IsDir() {
+		return "", http.StatusBadRequest, fmt.Errorf("%s is a directory", source)
+	}
+	for dir := filepath.Dir(path); dir != s.root; dir = filepath.Dir(dir) {
+		if !s.match.matchDir(dir) {
+			return "", http.StatusBadRequest, fmt.Errorf("%s is in %s, which isn't searched", source, dir)
+		}
+	}
+	if ok, reason := s.match.match(path, info); !ok {
+		if reason == "" {
+			reason = fmt.Sprintf("not a %s file", strings.Join(s.match.exts, "/"))
+		}
+		return "", http.StatusBadRequest, fmt.Errorf("%s isn't converted, %s", source, reason)
+	}
+	return path, 0, nil
+}
+
+// inDir reports whether path is inside dir, both being clean absolute paths.
+func inDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *apiServer) handleConvert(w http.ResponseWriter, r *http.Request) {
+	var req convertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	if req.Source == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no source supplied"))
+		return
+	}
+	source, status, err := s.checkSource(req.Source)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	opts := s.defaults
+	if len(req.Options) > 0 {
+		if opts, _, err = decodeRemoteOptions(req.Options, opts); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid options: %v", err))
+			return
+		}
+	} else if err := opts.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !s.inFlight.add(source) {
+		writeError(w, http.StatusConflict, fmt.Errorf("%s is already queued", req.Source))
+		return
+	}
+	info := s.jobs.add(source)
+	if !s.queue.push(job{id: info.ID, source: source, opts: &opts, priority: req.Priority}) {
+		s.inFlight.remove(source)
+		err := fmt.Errorf("no new conversions are being started")
+		s.jobs.finish(info.ID, result{err: err})
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, info)
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	jobs := s.jobs.list()
+	counts := map[string]int{jobQueued: 0, jobActive: 0, jobDone: 0, jobFailed: 0}
+	for _, j := range jobs {
+		counts[j.State]++
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Counts map[string]int `json:"counts"`
+		Jobs   []jobInfo      `json:"jobs"`
+	}{counts, jobs})
+}
+
+// health is the body of GET /healthz and GET /readyz.
+type health struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Workers int    `json:"workers"`
+	Active  int    `json:"active"`
+	Queued  int    `json:"queued"`
+}
+
+func (s *apiServer) health(status string) health {
+	counts := s.jobs.counts()
+	return health{Status: status, Workers: s.workers, Active: counts[jobActive], Queued: counts[jobQueued]}
+}
+
+// handleHealthz reports that the server is up, whatever its conversions do.
+func (s *apiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.health("ok"))
+}
+
+// handleReadyz reports whether jobs can be converted, which they can't
+// without ffmpeg.
+func (s *apiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.ffmpegErr != nil {
+		h := s.health("unavailable")
+		h.Error = s.ffmpegErr.Error()
+		writeJSON(w, http.StatusServiceUnavailable, h)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.health("ready"))
+}
+
+func (s *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.jobs.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// serve runs the HTTP API on addr until ctx is done, then shuts down
+// gracefully. Submitted jobs are pushed onto queue once match selects their
+// source under root.
+func serve(ctx context.Context, addr string, jobs *jobTracker, inFlight *inFlight, defaults options, match *matcher, root string, workers int, queue *jobQueue, logger *log.Logger) error {
+	s := &apiServer{jobs: jobs, inFlight: inFlight, queue: queue, defaults: defaults, match: match, root: root, workers: workers}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		s.ffmpegErr = fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("POST /convert", s.handleConvert)
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /jobs/{id}", s.handleJob)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errc := make(chan error, 1)
+	go func() {
+		logger.Printf("Listening on %s\n", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		logger.Println("Shutting down server")
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+		err = srv.Shutdown(shutdownCtx)
+		cancelShutdown()
+	}
+	return err
+}
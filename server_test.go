@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHandleConvertSource(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "movies")
+	writeTree(t, dir, "movies/a.mkv", "movies/.b.mkv", "movies/notes.txt", "movies/sub/c.mkv",
+		"movies/.hidden/d.mkv", "movies/extras/e.mkv", "elsewhere/f.mkv")
+	if err := os.Symlink(filepath.Join(dir, "elsewhere", "f.mkv"), filepath.Join(root, "f.mkv")); err != nil {
+		t.Skipf("can't symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a.mkv"), filepath.Join(dir, "elsewhere", "a.mkv")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		status int
+	}{
+		{"movies/a.mkv", http.StatusAccepted},
+		{"movies/sub/c.mkv", http.StatusAccepted},
+		// a link from outside the root to a source under it is that source, queued above
+		{"elsewhere/a.mkv", http.StatusConflict},
+		{"movies/missing.mkv", http.StatusBadRequest},
+		{"movies/sub", http.StatusBadRequest},
+		{"movies/notes.txt", http.StatusBadRequest},
+		{"movies/.b.mkv", http.StatusBadRequest},
+		{"movies/.hidden/d.mkv", http.StatusBadRequest},
+		{"movies/extras/e.mkv", http.StatusBadRequest},
+		{"elsewhere/f.mkv", http.StatusForbidden},
+		{"movies/f.mkv", http.StatusForbidden},
+		{"movies/../elsewhere/f.mkv", http.StatusForbidden},
+		{"movies", http.StatusForbidden},
+	}
+	realRoot, err := sourceRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &apiServer{
+		jobs: newJobTracker(), inFlight: newInFlight(), queue: newJobQueue(ctx, priorityFIFO), defaults: defaultOptions,
+		match: &matcher{exts: []string{".mkv"}, exclude: patternList{"extras"}, skipHidden: true}, root: realRoot,
+	}
+	for _, tt := range tests {
+		source := filepath.Join(dir, filepath.FromSlash(tt.source))
+		body := `{"source": ` + strconv.Quote(source) + `}`
+		rec := httptest.NewRecorder()
+		s.handleConvert(rec, httptest.NewRequest("POST", "/convert", strings.NewReader(body)))
+		if rec.Code != tt.status {
+			t.Errorf("POST /convert %s = %d %s, want %d", tt.source, rec.Code, strings.TrimSpace(rec.Body.String()), tt.status)
+		}
+	}
+	if got := len(s.jobs.list()); got != 2 {
+		t.Errorf("%d jobs queued, want 2", got)
+	}
+}
+
+func TestInDir(t *testing.T) {
+	sep := string(filepath.Separator)
+	root := sep + filepath.Join("srv", "movies")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(root, "a.mkv"), true},
+		{filepath.Join(root, "sub", "a.mkv"), true},
+		{filepath.Join(root, "..a.mkv"), true},
+		{root, false},
+		{filepath.Dir(root), false},
+		{root + "-old" + sep + "a.mkv", false},
+		{sep + filepath.Join("srv", "a.mkv"), false},
+	}
+	for _, tt := range tests {
+		if got := inDir(tt.path, root); got != tt.want {
+			t.Errorf("inDir(%q, %q) = %v, want %v", tt.path, root, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// sidecarExt is appended to a source's name to find the file overriding its
+// options, e.g. movie.mkv.json for movie.mkv. It holds an object with the
+// same names as the options of POST /convert, limited to remoteOptions.
+const sidecarExt = ".json"
+
+// applySidecar returns opts with the overrides from filename's sidecar file
+// applied, along with the names of the options it set. Without a sidecar
+// opts is returned unchanged.
+func applySidecar(filename string, opts options) (options, []string, error) {
+	sidecar := filename + sidecarExt
+	data, err := ioutil.ReadFile(sidecar)
+	if os.IsNotExist(err) {
+		return opts, nil, nil
+	} else if err != nil {
+		return opts, nil, err
+	}
+
+	opts, names, err := decodeRemoteOptions(data, opts)
+	if err != nil {
+		return opts, nil, fmt.Errorf("%s: %v", sidecar, err)
+	}
+	return opts, names, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRemoteOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		names []string
+		err   string // part of the error, "" for none
+	}{
+		{"codecs", `{"acodec": "aac", "ab": "192k"}`, []string{"ab", "acodec"}, ""},
+		{"empty", `{}`, []string{}, ""},
+		{"input args", `{"input_args": "-f lavfi"}`, nil, `"input_args"`},
+		{"ffmpeg args", `{"acodec": "aac", "ffmpeg_args": "-y /etc/passwd"}`, nil, `"ffmpeg_args"`},
+		{"lut", `{"codec": "libx264", "lut": "/etc/passwd.cube"}`, nil, `"lut"`},
+		{"unknown", `{"acodecs": "aac"}`, nil, `"acodecs"`},
+		{"invalid value", `{"ab": "loud"}`, nil, "invalid audio bitrate"},
+		{"path in the extension", `{"out_ext": "/../../x"}`, nil, "invalid -out-ext"},
+		{"not an object", `["acodec"]`, nil, "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		opts, names, err := decodeRemoteOptions([]byte(tt.json), defaultOptions)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.err)
+		case tt.err == "" && !reflect.DeepEqual(names, tt.names):
+			t.Errorf("%s: set %q, want %q", tt.name, names, tt.names)
+		case tt.err != "" && (opts.InputArgs != "" || opts.FFmpegArgs != "" || opts.LUT != ""):
+			t.Errorf("%s: raw arguments set despite the error: %+v", tt.name, opts)
+		}
+	}
+}
+
+func TestApplySidecar(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "movie.mkv")
+
+	opts, names, err := applySidecar(source, defaultOptions)
+	if err != nil || names != nil || !reflect.DeepEqual(opts, defaultOptions) {
+		t.Errorf("applySidecar without a sidecar = %+v, %q, %v, want the options unchanged", opts, names, err)
+	}
+
+	if err := ioutil.WriteFile(source+sidecarExt, []byte(`{"acodec": "aac", "ab": "192k"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts, names, err = applySidecar(source, defaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	} else if opts.AudioCodec != "aac" || opts.AudioBitrate != "192k" || opts.VideoCodec != defaultOptions.VideoCodec {
+		t.Errorf("applySidecar set %+v", opts)
+	} else if want := []string{"ab", "acodec"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("applySidecar set %q, want %q", names, want)
+	}
+
+	if err := ioutil.WriteFile(source+sidecarExt, []byte(`{"ffmpeg_args": "-y"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := applySidecar(source, defaultOptions); err == nil || !strings.Contains(err.Error(), source+sidecarExt) {
+		t.Errorf("applySidecar with ffmpeg_args = %v, want an error naming the sidecar", err)
+	}
+}
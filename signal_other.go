@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killedBySignal isn't supported on this platform.
+func killedBySignal(err error) (syscall.Signal, bool) {
+	return 0, false
+}
+
+// killGroup isn't supported on this platform, where cancelling cmd only
+// kills the process it started.
+func killGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sink stores finished outputs somewhere other than beside their sources.
+type Sink interface {
+	// Put stores the content of r under key, a slash separated path.
+	Put(ctx context.Context, key string, r io.Reader) error
+}
+
+// parseSink returns the Sink for uri, which is file:///some/dir or
+// s3://bucket/prefix.
+func parseSink(uri string) (Sink, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%s has no directory", uri)
+		}
+		return fileSink{dir: filepath.FromSlash(u.Path)}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%s has no bucket", uri)
+		}
+		return newS3Sink(u.Host, strings.Trim(u.Path, "/"))
+	}
+	return nil, fmt.Errorf("unknown sink %q (expected file:// or s3://)", uri)
+}
+
+// fileSink stores outputs in a local directory.
+type fileSink struct {
+	dir string
+}
+
+func (s fileSink) Put(ctx context.Context, key string, r io.Reader) error {
+	dst := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	// written next to dst and renamed, so dst never holds a partial file
+	part := dst + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(part, dst)
+	}
+	if err != nil {
+		os.Remove(part)
+	}
+	return err
+}
+
+// s3Sink stores outputs in an S3 compatible bucket with single PUT
+// requests, so outputs are limited to 5GB. The credentials, region and
+// endpoint are read from the usual AWS environment variables.
+type s3Sink struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func newS3Sink(bucket, prefix string) (*s3Sink, error) {
+	s := &s3Sink{
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("s3 sink needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("AWS_ENDPOINT_URL: %v", err)
+	}
+	return s, nil
+}
+
+func (s *s3Sink) Put(ctx context.Context, key string, r io.Reader) error {
+	objectURL := strings.TrimSuffix(s.endpoint.String(), "/") + awsEscapePath("/"+s.bucket+"/"+path.Join(s.prefix, key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, r)
+	if err != nil {
+		return err
+	}
+	if f, ok := r.(*os.File); ok {
+		// S3 needs the length up front rather than a chunked body
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		req.ContentLength = info.Size()
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 to req. The body isn't hashed, which
+// S3 allows over HTTPS.
+func (s *s3Sink) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-content-sha256", payload)
+	req.Header.Set("x-amz-date", amzDate)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var headers strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // no query
+		headers.String(),
+		strings.Join(signed, ";"),
+		payload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscapePath escapes p the way Signature Version 4 expects, every byte
+// but the unreserved characters and slashes.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sinkKey returns the key output is stored under: its path relative to the
+// input directory root, or just its name when it's outside root.
+func sinkKey(root, output string) string {
+	if root != "" {
+		if rel, err := filepath.Rel(root, output); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(output)
+}
+
+// upload stores output in the worker's sink and removes it, retrying per
+// the retry policy.
+func (w *worker) upload(output string) error {
+	key := sinkKey(w.sinkRoot, output)
+	for attempt := 1; ; attempt++ {
+		w.logger.Printf("Uploading %s as %s\n", output, key)
+		err := w.putFile(key, output)
+		if err == nil {
+			// the output is gone once uploaded, so its size is kept for
+			// the summary and -max-output-size
+			if info, err := os.Stat(output); err == nil {
+				w.uploaded += info.Size()
+			}
+			return os.Remove(output)
+		}
+		retries := w.retry.retriesFor(err)
+		if attempt > retries {
+			return fmt.Errorf("%w: %v", ErrSink, err)
+		}
+		delay := w.retry.delay(attempt)
+		w.errLogger.Printf("Error uploading %s (attempt %d of %d): %v, retrying in %s",
+			output, attempt, retries+1, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return fmt.Errorf("%w: %v", ErrSink, err)
+		}
+	}
+}
+
+func (w *worker) putFile(key, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.sink.Put(w.deadline, key, f)
+}
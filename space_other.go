@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// statFree isn't supported on this platform.
+func statFree(dir string) (fsFree, bool, error) {
+	return fsFree{}, false, nil
+}
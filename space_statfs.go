@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// statFree returns the free space of the file system holding dir.
+func statFree(dir string) (fsFree, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fsFree{}, false, err
+	}
+	return fsFree{
+		bytes:  uint64(st.Bavail) * uint64(st.Bsize),
+		inodes: uint64(st.Ffree),
+		// some file systems, such as btrfs, allocate inodes as needed and
+		// report none at all
+		inodesKnown: st.Files > 0,
+	}, true, nil
+}
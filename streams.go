@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+type streamInfo struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+type fileStreams struct {
+	File    string       `json:"file"`
+	Streams []streamInfo `json:"streams,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// listStreams probes each file and writes its streams to out as a table, or
+// as JSON when format is "json".
+func listStreams(files []string, format string, out io.Writer) error {
+	var list []fileStreams
+	for _, f := range files {
+		fs := fileStreams{File: f}
+		p, err := probe(f)
+		if err != nil {
+			fs.Error = err.Error()
+		} else {
+			for _, st := range p.Streams {
+				fs.Streams = append(fs.Streams, streamInfo{
+					Index:    st.Index,
+					Type:     st.CodecType,
+					Codec:    st.CodecName,
+					Language: st.Tags["language"],
+					Width:    st.Width,
+					Height:   st.Height,
+				})
+			}
+		}
+		list = append(list, fs)
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, fs := range list {
+		fmt.Fprintln(tw, fs.File)
+		if fs.Error != "" {
+			fmt.Fprintf(tw, "  error: %s\n", fs.Error)
+			continue
+		}
+		for _, st := range fs.Streams {
+			var res string
+			if st.Width > 0 {
+				res = fmt.Sprintf("%dx%d", st.Width, st.Height)
+			}
+			lang := st.Language
+			if lang == "" {
+				lang = "-"
+			}
+			fmt.Fprintf(tw, "  #%d\t%s\t%s\t%s\t%s\n", st.Index, st.Type, st.Codec, lang, res)
+		}
+	}
+	return tw.Flush()
+}
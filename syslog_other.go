@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// openSyslog fails since log/syslog isn't available on this platform.
+func openSyslog(addr string) (info, errs io.Writer, c io.Closer, err error) {
+	return nil, nil, nil, fmt.Errorf("-syslog isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+	"time"
+)
+
+// openSyslog connects to the local syslog daemon, or the one at addr when
+// it isn't empty, returning writers for the info and error loggers.
+func openSyslog(addr string) (info, errs io.Writer, c io.Closer, err error) {
+	network, raddr := syslogNetwork(addr)
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "mkv2mp4")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return syslogWriter{w: w}, syslogWriter{w: w, errs: true}, w, nil
+}
+
+// syslogWriter sends each line written by a logger as a syslog message. The
+// lines of the error logger are sent as warnings, notices for skipped files,
+// or errors, and the others at info.
+type syslogWriter struct {
+	w    *syslog.Writer
+	errs bool
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(trimLogTime(string(p)))
+	// a syslog that's gone away mustn't keep the line from the other
+	// writers of an io.MultiWriter
+	switch {
+	case !s.errs:
+		s.w.Info(msg)
+	case strings.Contains(msg, "Warning: "):
+		s.w.Warning(msg)
+	case strings.Contains(msg, "Skipping "):
+		s.w.Notice(msg)
+	default:
+		s.w.Err(msg)
+	}
+	return len(p), nil
+}
+
+// syslogNetwork splits a -syslog-addr such as tcp://logs:514 into its network
+// and address. Addresses without a network use UDP, and an empty one the
+// local daemon.
+func syslogNetwork(addr string) (network, raddr string) {
+	if addr == "" {
+		return "", ""
+	}
+	for _, n := range []string{"tcp", "udp"} {
+		if a := strings.TrimPrefix(addr, n+"://"); a != addr {
+			return n, a
+		}
+	}
+	return "udp", addr
+}
+
+// logTimeLayout is the date and time log.LstdFlags starts each line with.
+const logTimeLayout = "2006/01/02 15:04:05 "
+
+// trimLogTime drops the date and time from the start of a logged line, which
+// syslog records itself.
+func trimLogTime(line string) string {
+	if len(line) < len(logTimeLayout) {
+		return line
+	}
+	if _, err := time.Parse(logTimeLayout, line[:len(logTimeLayout)]); err != nil {
+		return line
+	}
+	return line[len(logTimeLayout):]
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package main
+
+import "testing"
+
+func TestSyslogNetwork(t *testing.T) {
+	tests := []struct {
+		addr, network, raddr string
+	}{
+		{"", "", ""},
+		{"logs:514", "udp", "logs:514"},
+		{"udp://logs:514", "udp", "logs:514"},
+		{"tcp://logs:601", "tcp", "logs:601"},
+		{"10.0.0.1:514", "udp", "10.0.0.1:514"},
+		{"[::1]:514", "udp", "[::1]:514"},
+	}
+	for _, tt := range tests {
+		network, raddr := syslogNetwork(tt.addr)
+		if network != tt.network || raddr != tt.raddr {
+			t.Errorf("syslogNetwork(%q) = %q, %q, want %q, %q", tt.addr, network, raddr, tt.network, tt.raddr)
+		}
+	}
+}
+
+func TestTrimLogTime(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"2026/10/14 15:04:05 Converting a.mkv to a.mp4\n", "Converting a.mkv to a.mp4\n"},
+		{"2026/10/14 15:04:05 ", ""},
+		{"Converting a.mkv to a.mp4\n", "Converting a.mkv to a.mp4\n"},
+		{"2026/10/14 Converting a.mkv\n", "2026/10/14 Converting a.mkv\n"},
+		{"1999/99/99 99:99:99 not a time\n", "1999/99/99 99:99:99 not a time\n"},
+		{"short", "short"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := trimLogTime(tt.line); got != tt.want {
+			t.Errorf("trimLogTime(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// muxOverhead is the share of an output taken by the container rather
+	// than its streams, left out of the bitrate -target-size aims for.
+	muxOverhead = 0.02
+	// defaultAudioBitrate is assumed for audio re-encoded without -ab, and
+	// copied audio whose bitrate ffprobe doesn't report.
+	defaultAudioBitrate = 128000
+
+	// minVideoBitrate and maxVideoBitrate bound the video bitrate picked
+	// for -target-size, in bits per second.
+	minVideoBitrate = 100000
+	maxVideoBitrate = 100000000
+)
+
+// twoPassCodecs are the video encoders whose -pass is used to hit a bitrate
+// more closely.
+var twoPassCodecs = map[string]bool{"libx264": true, "libvpx": true, "libvpx-vp9": true, "libaom-av1": true}
+
+// parseBitrate parses a bitrate such as 192k or 2M into bits per second.
+// Units are decimal, as ffmpeg's are.
+func parseBitrate(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1000
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult = 1000000
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", s)
+	}
+	return n * mult, nil
+}
+
+// formatBitrate formats bits per second for log output, e.g. 1.5Mb/s.
+func formatBitrate(n int64) string {
+	if n >= 1000000 {
+		return fmt.Sprintf("%.1fMb/s", float64(n)/1000000)
+	}
+	return fmt.Sprintf("%dkb/s", n/1000)
+}
+
+// targetBitrate returns the video bitrate fitting duration seconds of video
+// and audio bitrate audio in size bytes, clamped to minVideoBitrate and
+// maxVideoBitrate. It reports false when size is too small even for
+// minVideoBitrate.
+func targetBitrate(size int64, duration float64, audio int64) (int64, bool) {
+	total := float64(size) * 8 * (1 - muxOverhead) / duration
+	video := int64(total) - audio
+	switch {
+	case video < minVideoBitrate:
+		return minVideoBitrate, false
+	case video > maxVideoBitrate:
+		return maxVideoBitrate, true
+	}
+	return video, true
+}
+
+// audioBitrate returns the total bitrate of the audio streams o keeps from
+// the input probed as p.
+func (o options) audioBitrate(p *probeResult) int64 {
+	var total int64
+	for _, st := range o.keptStreams(p).streams("audio") {
+		rate := int64(defaultAudioBitrate)
+		if !o.audioCopied() && o.AudioBitrate != "" {
+			rate, _ = parseBitrate(o.AudioBitrate)
+		} else if o.audioCopied() {
+			if n, err := strconv.ParseInt(st.BitRate, 10, 64); err == nil && n > 0 {
+				rate = n
+			}
+		}
+		total += rate
+	}
+	return total
+}
+
+// applyTargetSize returns opts set up to encode the video of filename,
+// probed as p, at the bitrate fitting its output in -target-size.
+func (w *worker) applyTargetSize(filename string, opts options, p *probeResult) (options, error) {
+	size, _ := parseSize(opts.TargetSize)
+	duration := opts.clipDuration()
+	if duration <= 0 {
+		duration = p.duration()
+	}
+	if duration <= 0 {
+		return opts, fmt.Errorf("-target-size needs the duration of %s, which ffprobe didn't report", filename)
+	}
+	if opts.videoCopied() {
+		opts.VideoCodec = transcodeCodecs["video"]
+	}
+
+	video, ok := targetBitrate(size, duration, opts.audioBitrate(p))
+	if !ok {
+		w.errLogger.Printf("Warning: -target-size %s is too small for %s, encoding its video at %s, so the output will be larger",
+			opts.TargetSize, filename, formatBitrate(video))
+	} else {
+		w.logger.Printf("Encoding the video of %s at %s to fit %s\n", filename, formatBitrate(video), opts.TargetSize)
+	}
+	opts.videoBitrate = video
+	return opts, nil
+}
+
+// firstPass runs the first pass of a two-pass encode of filename with opts,
+// returning opts set up for the second pass and a func removing the first
+// pass's log. It does nothing for encoders without two passes.
+func (w *worker) firstPass(filename string, opts options, p *probeResult) (options, func(), error) {
+	if opts.videoBitrate == 0 || !twoPassCodecs[opts.VideoCodec] {
+		return opts, func() {}, nil
+	}
+	dir, err := ioutil.TempDir(w.tempDir, "mkv2mp4-pass-")
+	if err != nil {
+		return opts, func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	first := opts
+	first.pass, first.passLog = 1, filepath.Join(dir, "pass")
+	w.logger.Printf("Running the first pass of %s\n", filename)
+	if err := w.ffmpeg(first, p, filename, nullOutput); err != nil {
+		cleanup()
+		return opts, func() {}, fmt.Errorf("first pass: %w", err)
+	}
+	opts.pass, opts.passLog = 2, first.passLog
+	return opts, cleanup, nil
+}
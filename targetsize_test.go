@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTargetBitrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		duration float64
+		audio    int64
+		want     int64
+		ok       bool
+	}{
+		// 100MB over 800s is 1Mb/s, less 2% for the container and the audio
+		{"fits", 100000000, 800, 128000, 852000, true},
+		{"no audio", 100000000, 800, 0, 980000, true},
+		{"audio takes it all", 10000000, 800, 128000, minVideoBitrate, false},
+		{"too small", 1000000, 3600, 128000, minVideoBitrate, false},
+		{"clamped high", 1000000000000, 1, 128000, maxVideoBitrate, true},
+		{"at the ceiling", 12755102041, 1000, 0, maxVideoBitrate, true},
+		{"at the floor", 12755103, 1000, 0, 100000, true},
+	}
+	for _, tt := range tests {
+		got, ok := targetBitrate(tt.size, tt.duration, tt.audio)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: targetBitrate(%d, %g, %d) = %d, %v, want %d, %v", tt.name, tt.size, tt.duration, tt.audio, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"128000", 128000, true},
+		{"192k", 192000, true},
+		{"192K", 192000, true},
+		{"2M", 2000000, true},
+		{"2m", 2000000, true},
+		{"0", 0, true},
+		{"1.5M", 0, false},
+		{"-5k", 0, false},
+		{"k", 0, false},
+		{"", 0, false},
+		{"128kb", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBitrate(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBitrate(%q) = %d, %v, want %d, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatBitrate(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{128000, "128kb/s"},
+		{999999, "999kb/s"},
+		{1000000, "1.0Mb/s"},
+		{1500000, "1.5Mb/s"},
+	}
+	for _, tt := range tests {
+		if got := formatBitrate(tt.n); got != tt.want {
+			t.Errorf("formatBitrate(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestAudioBitrate(t *testing.T) {
+	p := &probeResult{Streams: []probeStream{
+		{Index: 0, CodecType: "video", BitRate: "8000000"},
+		{Index: 1, CodecType: "audio", BitRate: "640000"},
+		{Index: 2, CodecType: "audio"},
+	}}
+	tests := []struct {
+		name       string
+		acodec, ab string
+		want       int64
+	}{
+		{"copied", "", "", 640000 + defaultAudioBitrate},
+		{"re-encoded", "aac", "", 2 * defaultAudioBitrate},
+		{"re-encoded with -ab", "aac", "192k", 2 * 192000},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions
+		opts.AudioCodec, opts.AudioBitrate = tt.acodec, tt.ab
+		if got := opts.audioBitrate(p); got != tt.want {
+			t.Errorf("%s: audioBitrate = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFirstPassFailureRemovesNothing(t *testing.T) {
+	if _, err := exec.LookPath("false"); err != nil {
+		t.Skip("no false command to stand in for a failing ffmpeg")
+	}
+	execWrapper = []string{"false"}
+	defer func() { execWrapper = nil }()
+
+	// a file named like the null output, where a relative "-" would be removed
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, name := range []string{"-", "in.mkv"} {
+		if err := ioutil.WriteFile(name, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	w := &worker{deadline: context.Background(), tempDir: dir, logger: logger, errLogger: logger}
+	opts := defaultOptions
+	opts.VideoCodec, opts.videoBitrate = "libx264", 1000000
+	if _, _, err := w.firstPass(filepath.Join(dir, "in.mkv"), opts, nil); err == nil {
+		t.Fatal("firstPass succeeded with a failing ffmpeg")
+	}
+	if got, want := dirNames(t, dir), []string{"-", "in.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+	if info, err := os.Stat(os.DevNull); err != nil {
+		t.Errorf("%s is gone: %v", os.DevNull, err)
+	} else if info.Mode()&os.ModeDevice == 0 {
+		t.Errorf("%s isn't a device: %v", os.DevNull, info.Mode())
+	}
+}
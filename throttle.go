@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// throttledReader reads from r at no more than rate bytes per second.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newThrottledReader(r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{r: r, rate: rate, start: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// read in chunks of at most a tenth of a second so the rate stays smooth
+	if max := t.rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+	return n, err
+}
+
+// ffmpeg converts filename to output, feeding ffmpeg the source through a
+// throttledReader when there's a -read-rate.
+func (w *worker) ffmpeg(opts options, src *probeResult, filename, output string) error {
+	if w.readRate <= 0 {
+		return runFFmpeg(w.deadline, ffmpegArgs(opts, src, filename, output), nil, output, opts)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return runFFmpeg(w.deadline, ffmpegArgs(opts, src, "pipe:0", output), newThrottledReader(f, w.readRate), output, opts)
+}
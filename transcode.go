@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// transcodeCodecs are the codecs -transcode-missing converts a stream type
+// with when it can't be copied.
+var transcodeCodecs = map[string]string{
+	"video":    "libx264",
+	"audio":    "aac",
+	"subtitle": "mov_text",
+}
+
+// transcodeMissing is the second stage of -transcode-missing. convErr is the
+// result of converting filename to output with opts. When that failed on, or
+// lost, a stream type that was copied, the conversion is run again
+// transcoding only that type.
+func (w *worker) transcodeMissing(filename, output string, opts options, src *probeResult, convErr error) error {
+	var types []string
+	if convErr != nil {
+		types = incompatibleStreams(src, opts)
+	} else {
+		out, err := probe(output)
+		if err != nil {
+			return fmt.Errorf("probing output: %v", err)
+		}
+		types = missingStreams(opts.keptStreams(src), out, opts)
+	}
+	if len(types) == 0 {
+		return convErr
+	}
+
+	w.logger.Printf("Converting %s again, transcoding its %s streams\n", filename, strings.Join(types, " and "))
+	os.Remove(output)
+	for _, t := range types {
+		switch t {
+		case "video":
+			opts.VideoCodec = transcodeCodecs[t]
+		case "audio":
+			opts.AudioCodec = transcodeCodecs[t]
+		case "subtitle":
+			opts.subtitleCodec = transcodeCodecs[t]
+		}
+	}
+	return w.ffmpeg(opts, src, filename, output)
+}
+
+// copiedTypes returns the stream types opts copies as-is.
+func copiedTypes(opts options) []string {
+	var types []string
+	if opts.videoCopied() {
+		types = append(types, "video")
+	}
+	if opts.audioCopied() {
+		types = append(types, "audio")
+	}
+	return append(types, "subtitle")
+}
+
+// incompatibleStreams returns the copied stream types of src holding a codec
+// the default rules don't copy into MP4.
+func incompatibleStreams(src *probeResult, opts options) []string {
+	var types []string
+	for _, t := range copiedTypes(opts) {
+		for _, st := range src.streams(t) {
+			if ru := defaultRules.match(st); ru.action != ruleCopy && ru.action != ruleDrop {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+	return types
+}
+
+// missingStreams returns the copied stream types of src that are absent from
+// out or that ffprobe can't make sense of there. Without -map ffmpeg picks a
+// single stream of each type, so one is all that's expected.
+func missingStreams(src, out *probeResult, opts options) []string {
+	var types []string
+	for _, t := range copiedTypes(opts) {
+		if len(src.streams(t)) == 0 {
+			continue
+		}
+		got := out.streams(t)
+		if len(got) == 0 || !validStream(got[0]) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func validStream(st probeStream) bool {
+	if st.CodecName == "" {
+		return false
+	}
+	return st.CodecType != "video" || (st.Width > 0 && st.Height > 0)
+}
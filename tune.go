@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// tuneGain is how much faster conversions have to get after adding a worker
+// for -auto-concurrency to try another one.
+const tuneGain = 0.05
+
+// concurrencyTuner picks how many of the workers convert at once for
+// -auto-concurrency, by hill climbing: starting from one, a worker is added
+// each time the source bytes converted per second rose by more than tuneGain
+// over the last interval, and the last one is taken away again once it
+// didn't, which settles the count. Workers numbered past the count wait,
+// finishing their conversion first. It's safe for concurrent use.
+type concurrencyTuner struct {
+	max      int
+	interval time.Duration
+	logger   *log.Logger
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	settled bool
+	closed  bool
+
+	// the current interval's converted files and their bytes, and the
+	// previous interval's rate
+	start    time.Time
+	files    int
+	bytes    int64
+	lastRate float64
+}
+
+func newConcurrencyTuner(ctx context.Context, max int, interval time.Duration, logger *log.Logger) *concurrencyTuner {
+	t := &concurrencyTuner{max: max, interval: interval, logger: logger, limit: 1, start: time.Now()}
+	t.cond = sync.NewCond(&t.mu)
+	if max <= 1 {
+		t.settled = true
+	}
+	go func() {
+		<-ctx.Done()
+		t.mu.Lock()
+		t.mu.Unlock()
+		t.cond.Broadcast()
+	}()
+	logger.Printf("-auto-concurrency starting with 1 of up to %d concurrent conversions\n", max)
+	return t
+}
+
+// wait blocks while the worker numbered id is past the count, returning
+// false if ctx is done or t closed first. Workers within the count carry on
+// after t is closed, converting what's left in the queue.
+func (t *concurrencyTuner) wait(ctx context.Context, id int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id > t.limit && !t.closed && ctx.Err() == nil {
+		t.cond.Wait()
+	}
+	return id <= t.limit && ctx.Err() == nil
+}
+
+// record adds the result of a finished conversion to the current interval,
+// adjusting the count once the interval is over.
+func (t *concurrencyTuner) record(res result) {
+	if res.status != statusConverted {
+		// skips and failures are no measure of throughput
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.settled {
+		return
+	}
+	t.files++
+	t.bytes += res.sourceSize
+	elapsed := time.Since(t.start)
+	// each worker converting finishes a file first, so its throughput counts
+	if elapsed < t.interval || t.files < t.limit {
+		return
+	}
+
+	rate := float64(t.bytes) / elapsed.Seconds()
+	switch {
+	case t.lastRate > 0 && rate <= t.lastRate*(1+tuneGain):
+		t.limit--
+		t.settled = true
+		t.logger.Printf("-auto-concurrency: %s/s converting %d at a time isn't faster than %s/s, going back to %d\n",
+			formatSize(int64(rate)), t.limit+1, formatSize(int64(t.lastRate)), t.limit)
+	case t.limit == t.max:
+		t.settled = true
+	default:
+		t.limit++
+		t.logger.Printf("-auto-concurrency: %s/s converting %d at a time, trying %d\n", formatSize(int64(rate)), t.limit-1, t.limit)
+		t.cond.Broadcast()
+	}
+	if t.settled {
+		t.logger.Printf("-auto-concurrency settled on %d concurrent conversions\n", t.limit)
+	}
+	t.lastRate = rate
+	t.start, t.files, t.bytes = time.Now(), 0, 0
+}
+
+// close lets the waiting workers stop, for once the queue is closed and
+// empty.
+func (t *concurrencyTuner) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+// settledOn returns the count, and whether it's settled.
+func (t *concurrencyTuner) settledOn() (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit, t.settled
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// removalQueue holds the sources of verified conversions with -two-phase,
+// which are only removed once the whole run has succeeded. It's safe for
+// concurrent use.
+type removalQueue struct {
+	mu      sync.Mutex
+	sources []string
+}
+
+func (q *removalQueue) add(source string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sources = append(q.sources, source)
+}
+
+func (q *removalQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.sources)
+}
+
+// removeAll removes the queued sources, asking confirm first if it isn't
+// nil, and returns how many couldn't be removed. Once deletes is reached the
+// rest are kept.
+func (q *removalQueue) removeAll(confirm *confirmer, deletes *deleteCap, links *linkTracker, logger, errLogger *log.Logger) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	failed := 0
+	for _, source := range q.sources {
+		if confirm != nil && !confirm.ask(source) {
+			logger.Printf("Keeping %s\n", source)
+			continue
+		}
+		if !deletes.take(1) {
+			errLogger.Printf("Keeping %s and the other remaining sources: -max-deletes reached", source)
+			break
+		}
+		if err := links.remove(source, logger, errLogger); err != nil {
+			errLogger.Printf("Error removing %s: %v", source, err)
+			failed++
+		}
+	}
+	q.sources = nil
+	return failed
+}
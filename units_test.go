@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"1K", 1024, true},
+		{"1.5G", 1536 << 20, true},
+		{" 25m ", 25 << 20, true},
+		{"0", 0, true},
+		{"-1M", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"NaN", 0, false},
+		{"1e400", 0, false},
+		{"1e19", 0, false},
+		{"8E", 0, false},
+		{"10000000T", 0, false},
+		{"lots", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Depths of the -validate-input check.
+const (
+	validateHeader = "header" // ffprobe reads the container and stream headers
+	validateFull   = "full"   // ffmpeg decodes every stream
+)
+
+// checkReadable opens filename and reads its first byte, returning an error
+// wrapping ErrUnreadable if it can't, e.g. because of its permissions or a
+// failing mount. It tells files ffmpeg can't even open apart from ones it
+// fails to convert.
+func checkReadable(filename string) error {
+	f, err := os.Open(filename)
+	if err == nil {
+		_, err = f.Read(make([]byte, 1))
+		f.Close()
+	}
+	if err != nil && err != io.EOF {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return fmt.Errorf("%w: %v", ErrUnreadable, err)
+	}
+	return nil
+}
+
+// validateInput checks that filename isn't corrupt, to the given depth,
+// returning an error wrapping ErrSourceCorrupt if it is.
+func (w *worker) validateInput(filename, depth string) error {
+	if _, err := verifyFile(filename); err != nil {
+		return fmt.Errorf("%w: %v", ErrSourceCorrupt, err)
+	}
+	if depth != validateFull {
+		return nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := ffmpegCommand(w.deadline, "-v", "error", "-i", filename, "-f", "null", "-")
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if w.deadline.Err() != nil {
+		return ErrTimeout
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i]
+		}
+		return fmt.Errorf("%w: %s", ErrSourceCorrupt, msg)
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", ErrSourceCorrupt, err)
+	}
+	return nil
+}